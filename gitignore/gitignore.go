@@ -0,0 +1,119 @@
+// SPDX-License-Identifier: MIT
+
+// Package gitignore matches paths against the patterns of .gitignore files, for gotags's
+// --respect-gitignore.
+package gitignore
+
+import (
+	"path"
+	"strings"
+)
+
+// Patterns are the patterns of one .gitignore file, which apply to the paths below the directory
+// of the file.  The common forms of pattern are supported:
+//
+//   - blank lines and lines starting with '#' are ignored, and '\#' and '\!' start patterns with
+//     a literal '#' or '!'
+//   - a leading '!' negates the pattern, so that a path it matches is not ignored after all
+//   - a trailing '/' makes the pattern match only directories
+//   - a pattern with a '/' other than at the end is relative to the directory of the file, any
+//     other pattern matches a name at any depth
+//   - '*', '?' and '[...]' match within a path component as for path.Match, and a component '**'
+//     matches any number of components
+//
+// Not supported are trailing spaces escaped with '\', and a '**' that is not a whole component,
+// which is matched as '*'.  Rules from files other than .gitignore files, such as .git/info/exclude
+// and core.excludesFile, are up to the caller, as is the rule that a path can't be re-included if
+// a directory above it is ignored, which follows naturally when ignored directories are not
+// descended into.
+type Patterns struct {
+	rules []gitignoreRule
+}
+
+type gitignoreRule struct {
+	components []string
+	negated    bool
+	dirOnly    bool
+	anchored   bool
+}
+
+// Parse parses the text of a .gitignore file.
+func Parse(text string) *Patterns {
+	g := &Patterns{}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var r gitignoreRule
+		if strings.HasPrefix(line, "!") {
+			r.negated = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		r.anchored = strings.Contains(line, "/")
+		line = strings.TrimLeft(line, "/")
+		if line == "" {
+			continue
+		}
+		r.components = strings.Split(line, "/")
+		g.rules = append(g.rules, r)
+	}
+	return g
+}
+
+// Match matches the slash-separated path, relative to the directory of the .gitignore file,
+// against the patterns.  It returns whether any pattern matched and, if so, whether the last
+// matching pattern ignores the path.
+func (g *Patterns) Match(relPath string, isDir bool) (matched, ignored bool) {
+	components := strings.Split(relPath, "/")
+	for _, r := range g.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		var ok bool
+		if r.anchored {
+			ok = matchComponents(r.components, components)
+		} else {
+			ok = matchComponents(r.components, components[len(components)-1:])
+		}
+		if ok {
+			matched, ignored = true, !r.negated
+		}
+	}
+	return
+}
+
+func matchComponents(patterns, names []string) bool {
+	if len(patterns) == 0 {
+		return len(names) == 0
+	}
+	// A trailing "**" matches everything inside a directory but not the directory itself.
+	if patterns[0] == "**" && len(patterns) == 1 {
+		return len(names) > 0
+	}
+	if patterns[0] == "**" {
+		for i := 0; i <= len(names); i++ {
+			if matchComponents(patterns[1:], names[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(names) == 0 {
+		return false
+	}
+	pattern := patterns[0]
+	for strings.Contains(pattern, "**") {
+		pattern = strings.ReplaceAll(pattern, "**", "*")
+	}
+	if ok, err := path.Match(pattern, names[0]); err != nil || !ok {
+		return false
+	}
+	return matchComponents(patterns[1:], names[1:])
+}
@@ -0,0 +1,52 @@
+// SPDX-License-Identifier: MIT
+
+package gitignore
+
+import (
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	g := Parse(`# A comment
+
+/gen/
+*.pb.go
+!keep.pb.go
+build/
+docs/**/*.go
+a/**
+**/logs
+\#hash
+\!bang
+`)
+	for _, c := range []struct {
+		path             string
+		isDir            bool
+		matched, ignored bool
+	}{
+		{"gen", true, true, true},
+		{"gen", false, false, false},
+		{"sub/gen", true, false, false},
+		{"x.pb.go", false, true, true},
+		{"sub/x.pb.go", false, true, true},
+		{"keep.pb.go", false, true, false},
+		{"sub/build", true, true, true},
+		{"sub/build", false, false, false},
+		{"docs/d.go", false, true, true},
+		{"docs/x/y/d.go", false, true, true},
+		{"docs/d.py", false, false, false},
+		{"sub/docs/d.go", false, false, false},
+		{"a/b/c", false, true, true},
+		{"a", true, false, false},
+		{"logs", true, true, true},
+		{"x/y/logs", false, true, true},
+		{"#hash", false, true, true},
+		{"!bang", false, true, true},
+		{"A comment", false, false, false},
+	} {
+		matched, ignored := g.Match(c.path, c.isDir)
+		if matched != c.matched || ignored != c.ignored {
+			t.Fatalf("%s: Got %v %v want %v %v", c.path, matched, ignored, c.matched, c.ignored)
+		}
+	}
+}
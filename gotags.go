@@ -4,11 +4,30 @@
 Gotags generates an etags-like tag file for Go and Python source, with better Go and Python
 awareness than etags.
 
-Input file names are provided on the command line.  If the only input file name is given as "-" then
-the names of input files are read from standard input, one name per line.
+Input file names are provided on the command line.  An input file name given as "-" stands for the
+names of input files read from standard input, one name per line (or with -0, terminated by NUL
+characters, as written by find -print0), and can be given only once.  An argument @listfile stands
+for the file names listed in listfile, one per line, ignoring blank lines and lines starting with #.
 
-Input files with extension other than .go are processed by the native etags into the specified output
-file.
+With -R, a directory name (or dir/...) stands for the Go and Python files in the directory tree, in
+lexical order, except in vendor and hidden directories and those named by --exclude-dir, and with
+--respect-gitignore also except the paths ignored by the common forms of pattern in .gitignore files
+in the tree.  The input files are tagged in the order they are given, or with --deterministic in
+sorted order of name, so that the output does not depend on the order of the inputs.  With --tags,
+Go files that are excluded by their build constraints (//go:build lines and _GOOS/_GOARCH file name
+suffixes) for the host and the given build tags are skipped.  The Go files of the packages matching
+a go list(1) pattern can also be tagged with --packages, which respects build constraints and leaves
+out test files.  Go files that are marked as generated, with a "// Code generated ... DO NOT EDIT."
+comment before the package clause, are skipped unless --include-generated is given.  Go test files,
+named *_test.go, are skipped with --no-tests, or are the only Go files tagged with --only-tests.
+Input files of any kind can be skipped by name with the regular expressions of --exclude and
+--include.  A policy for --kinds, --exclude and --include that is shared between projects can be
+kept in a file of key=value lines, such as kinds=func,type, and given by --kind-filter-file; the
+options given on the command line override it.
+
+Input files with extension other than .go and .py are processed by the native etags into the
+specified output file, except that --lang-map can map other extensions to Go or Python.  Their
+sections follow those of the other files, or are in input order with --preserve-order.
 
 &&USAGE will be inserted here by `make README.md`, or run gotags -h to see it&&
 
@@ -16,20 +35,77 @@ Tags are generated for all Go global names: packages, types, constants, function
 members of global interfaces and structs, irrespective of the declaration syntax.  In contrast,
 etags does not handle constants or variables, nor types defined inside type lists, nor functions or
 types with type parameters, nor interface or struct members, and it can mistake local type
-declarations for global ones.
+declarations for global ones.  The kinds of names to tag can be narrowed with --kinds, and the
+members to those of structs or interfaces with --members.  With --imports, the local names that
+import declarations give to packages are tagged as well, and with --linknames the local names of
+//go:linkname directives, at the directives.
 
 For full Go functionality, gotags requires each Go input file to be syntactically well-formed in the
-sense of "go/parser".  If a .go file cannot be parsed, gotags prints a warning and falls back to
-its own etags-style parsing.
+sense of "go/parser".  If a .go file cannot be parsed, gotags prints a warning and by default tags
+the declarations that the parser could make out, or falls back to its own etags-style parsing if the
+file is unusable, see --on-parse-error.  The tagging of parsed Go files is also available to Go
+programs as the package gotags/tags.
+
+With --include-readme-tags, Go declarations in fenced ```go code blocks of Markdown (.md) files are
+tagged as for Go files, with line numbers and offsets relative to the Markdown file.  Blocks that
+lack a package clause are accepted.
+
+Optionally gotags also records references to names, as opposed to their definitions, for example
+with --func-signature-refs the named types in function signatures, and with --method-type-refs the
+receiver types of methods.  References are written to a separate file (by default REFS) in the same
+format as the tags file, so that Emacs can load it as a tags table to find the uses of a name.
+
+With --filter-plugin, the tags that gotags generates itself (not those from the native etags) are
+filtered by an external command, run once by /bin/sh.  The command reads one line per candidate tag
+on stdin, of the form "name<TAB>file<TAB>line<TAB>kind", where kind is one of package, type, const,
+var, func, member, method-field (a struct field of function type), import and linkname, and writes
+to stdout the lines of the tags to keep, unchanged.
+
+With --format=ctags, gotags writes a ctags-style tags file instead, as used by vi and other editors:
+one line per tag, "name<TAB>file<TAB>/^pattern/;"<TAB>kind:k", sorted by name, where the kind k
+is one of p (package), t (type), f (func), v (var), c (const), m (member), M (method-field), i
+(import) and l (linkname).  The line of a method then has "<TAB>struct:T" for its receiver type
+T, with --enum-scope the line of a constant of a named type T has "<TAB>enum:T", and every line
+ends with "<TAB>end:N" for the offset N just past the name.  Files that would be passed to the
+native etags are not tagged in this format.  A references file is always in the etags format.  The
+lines of a ctags file can end with CRLF, with --output-line-endings=crlf.
+
+With --format=json, gotags writes a JSON array of tag objects with the fields name, file, line,
+offset, end (the offset just past the name), kind and pattern, or with --json-lines one such object
+per line.  As for ctags, files that would be passed to the native etags are not tagged.
+
+With --header, an etags file starts with a line "gotags VERSION format=etags", which Emacs ignores
+as it precedes the first tagsection, and a ctags file with the pseudo-tags !_TAG_PROGRAM_NAME and
+!_TAG_PROGRAM_VERSION.
 
 Tags are generated for Python function and class definitions.  This uses etags-style parsing but with
 better patterns than etags.
 
-Input file names are emitted verbatim in the output, gotags has no resolution of relative file names
-wrt the location of the output file as in etags, nor has it support for other exotic etags
-functionality, such as compressed files.
+Input file names are emitted verbatim in the output unless --relative is given, in which case
+relative file names are rewritten relative to the directory of the output file as in etags (except
+when writing to stdout).  With --output-directory, the output files are written into the given
+directory, which is created if necessary, and file names are relative to it.  With --per-dir, the
+input files are grouped by directory and each group is tagged into a tags file in its directory,
+named by the basename of the output file, with file names relative to that directory.
+
+With --incremental, the sections of an existing tags file are reused for the input files that have
+not been modified since it was written, and only the other input files are tagged anew.  Files that
+are no longer input are dropped from the tags file.
+
+Tag offsets are byte offsets into the input file unless --char-offsets is given, in which case they
+are character offsets, for Emacs configurations that read them as character positions in files with
+multibyte text.  With --no-offsets, which only works with etags output, tags have only line numbers,
+and the records of the tags file end with "line," for strict etags readers that don't accept
+offsets.  This does not affect the output of the native etags.
+
+Go and Python files compressed with gzip, with names ending in .gz, are decompressed before tagging,
+and tagged under their compressed names as in etags.  Gotags has no support for other exotic etags
+functionality.
 
 Files that are passed to the native etags are processed entirely according to etags's semantics.
+The native etags is the program named by --etags, or if that is not given by the environment
+variable GOTAGS_ETAGS, or else /usr/bin/etags.  Either can be empty to not run it at all.  If it
+can't be run, gotags warns and its files are left untagged, but the other files are tagged as usual.
 
 To use gotags with Emacs's etags-regen-mode or complete-symbol it is sufficient to set
 etags-program-name to "gotags" in your .emacs.  Note however that gotags does not yet respect any
@@ -38,24 +114,65 @@ regular expression settings in that mode for any language.
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"go/ast"
+	"go/build"
+	"go/build/constraint"
 	"go/parser"
 	"go/token"
 	"io"
+	"io/fs"
 	"iter"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
+	"gotags/gitignore"
+	"gotags/tags"
 	"gotags/utils"
 )
 
 const VERSION = "0.5.0-devel"
 
+func setKinds(s string) error {
+	kinds := kindSet(s)
+	for k := range kinds {
+		if !kindSet(defaultKinds)[k] {
+			return fmt.Errorf("Unknown kind \"%s\"", k)
+		}
+	}
+	tagKinds = kinds
+	return nil
+}
+
+func pushRegexp(res *[]*regexp.Regexp) func(string) error {
+	return func(s string) error {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return err
+		}
+		*res = append(*res, re)
+		return nil
+	}
+}
+
 var (
 	outname            string
 	systemEtagsCommand string
@@ -65,25 +182,160 @@ var (
 	help               bool
 	inputFilenames     []string
 	namesFromStdin     bool
-	members            bool
+	tagKinds           map[string]bool
+	outputBom          bool
+	jobsStdin          bool
+	inlineMethods      bool
+	dumpAst            bool
+	readmeTags         bool
+	funcSigRefs        bool
+	refsname           string
+	nullOutput         bool
+	coalesceFields     bool
+	packagePatterns    []string
+	filterPlugin       string
+	onParseError       string
+	methodTypeRefs     bool
+	debugSections      string
+	anonFuncs          bool
+	mergeSections      bool
+	appendOutput       bool
+	format             string
+	jsonLines          bool
+	relative           bool
+	recursive          bool
+	jobs               int
+	exportedOnly       bool
+	qualifiedMembers   bool
+	buildTags          []string
+	includeGenerated   bool
+	perDir             bool
+	nullInput          bool
+	incremental        bool
+	stdinName          string
+	resolveSymlinks    bool
+	charOffsets        bool
+	sortOrder          string
+	noTests            bool
+	onlyTests          bool
+	showStats          bool
+	excludeRes         []*regexp.Regexp
+	includeRes         []*regexp.Regexp
+	header             bool
+	structMembers      bool
+	interfaceMembers   bool
+	aliasTargets       bool
+	dryRun             bool
+	respectGitignore   bool
+	langMap            map[string]string
+	preserveOrder      bool
+	errorOnFallback    bool
+	deterministic      bool
+	importNames        bool
+	outputDir          string
+	excludeDirs        []string
+	maxFileSize        int
+	showTimings        bool
+	linknames          bool
+	noOffsets          bool
+	enumScope          bool
+	kindFilterFile     string
+	kindsGiven         bool
+	lineEndings        string
+	strict             bool
+	onParseErrorGiven  bool
 )
 
+// With --relative, the directories of the tags and references files, "" when writing to stdout.
+var tagsDir, refsDir string
+
 const (
-	defaultOutname = "TAGS"
-	defaultEtags   = "/usr/bin/etags"
-	defaultMembers = true
+	defaultOutname      = "TAGS"
+	defaultEtags        = "/usr/bin/etags"
+	defaultKinds        = "package,type,const,var,func,member,import,linkname"
+	defaultRefsname     = "REFS"
+	defaultOnParseError = "fallback"
+	defaultFormat       = "etags"
+	defaultJobs         = 1
+	defaultSortOrder    = "none"
+	defaultMembers      = "struct,interface"
+	defaultLineEndings  = "lf"
 )
 
 func clearOptions() {
 	outname = defaultOutname
 	systemEtagsCommand = defaultEtags
+	if command, found := os.LookupEnv("GOTAGS_ETAGS"); found {
+		systemEtagsCommand = command
+	}
 	quiet = false
 	verbose = false
 	version = false
 	help = false
 	inputFilenames = make([]string, 0)
 	namesFromStdin = false
-	members = defaultMembers
+	tagKinds = kindSet(defaultKinds)
+	outputBom = false
+	jobsStdin = false
+	inlineMethods = false
+	dumpAst = false
+	readmeTags = false
+	funcSigRefs = false
+	refsname = defaultRefsname
+	nullOutput = false
+	coalesceFields = false
+	packagePatterns = make([]string, 0)
+	filterPlugin = ""
+	onParseError = defaultOnParseError
+	methodTypeRefs = false
+	debugSections = ""
+	anonFuncs = false
+	mergeSections = false
+	appendOutput = false
+	format = defaultFormat
+	jsonLines = false
+	relative = false
+	recursive = false
+	jobs = defaultJobs
+	exportedOnly = false
+	qualifiedMembers = false
+	buildTags = nil
+	includeGenerated = false
+	perDir = false
+	nullInput = false
+	incremental = false
+	stdinName = ""
+	resolveSymlinks = false
+	charOffsets = false
+	sortOrder = defaultSortOrder
+	noTests = false
+	onlyTests = false
+	showStats = false
+	excludeRes = nil
+	includeRes = nil
+	header = false
+	structMembers = true
+	interfaceMembers = true
+	aliasTargets = false
+	dryRun = false
+	respectGitignore = false
+	langMap = make(map[string]string)
+	preserveOrder = false
+	errorOnFallback = false
+	deterministic = false
+	importNames = false
+	outputDir = ""
+	excludeDirs = nil
+	maxFileSize = 0
+	showTimings = false
+	linknames = false
+	noOffsets = false
+	enumScope = false
+	kindFilterFile = ""
+	kindsGiven = false
+	lineEndings = defaultLineEndings
+	strict = false
+	onParseErrorGiven = false
 }
 
 var opts = []utils.Option{
@@ -100,6 +352,30 @@ var opts = []utils.Option{
 		Value:   true,
 		Handler: utils.SetString(&outname),
 	},
+	utils.Option{
+		Short:   'f',
+		Help:    "`Filename` of output file, same as -o, for compatibility with etags",
+		Value:   true,
+		Handler: utils.SetString(&outname),
+	},
+	utils.Option{
+		Short:   'a',
+		Long:    "append",
+		Help:    "Append to the output file instead of overwriting it, for etags output only",
+		Handler: utils.SetFlag(&appendOutput),
+	},
+	utils.Option{
+		Short:   'R',
+		Long:    "recursive",
+		Help:    "Tag the Go and Python files in the trees of directory arguments",
+		Handler: utils.SetFlag(&recursive),
+	},
+	utils.Option{
+		Short:   '0',
+		Long:    "null",
+		Help:    "Input file names read from stdin are terminated by NUL, not newline",
+		Handler: utils.SetFlag(&nullInput),
+	},
 	utils.Option{
 		Short:   'q',
 		Long:    "quiet",
@@ -122,7 +398,7 @@ var opts = []utils.Option{
 		Long: "etags",
 		Help: fmt.Sprintf(
 			"`Filename` of the native etags program, \"\" to disable this functionality,\n"+
-				"	default \"%s\"",
+				"	default $GOTAGS_ETAGS if set, else \"%s\"",
 			defaultEtags,
 		),
 		Value:   true,
@@ -130,16 +406,418 @@ var opts = []utils.Option{
 	},
 	utils.Option{
 		Long: "no-members",
-		Help: "Do not tag member variables",
+		Help: "Do not tag members, same as --members=\"\"",
+		Handler: func(_ string) error {
+			structMembers = false
+			interfaceMembers = false
+			return nil
+		},
+	},
+	utils.Option{
+		Long: "kinds",
+		Help: fmt.Sprintf(
+			"Comma-separated `list` of the kinds of names to tag, default \"%s\"", defaultKinds),
+		Value: true,
+		Handler: func(s string) error {
+			kindsGiven = true
+			return setKinds(s)
+		},
+	},
+	utils.Option{
+		Long:    "output-bom",
+		Help:    "Write a UTF-8 byte order mark at the start of the output",
+		Handler: utils.SetFlag(&outputBom),
+	},
+	utils.Option{
+		Long:    "jobs-stdin",
+		Help:    "Read input file names from stdin concurrently with tagging",
+		Handler: utils.SetFlag(&jobsStdin),
+	},
+	utils.Option{
+		Long:    "inline-interface-methods",
+		Help:    "Tag methods of interface types given inline as struct member types",
+		Handler: utils.SetFlag(&inlineMethods),
+	},
+	utils.Option{
+		Long:    "dump-ast",
+		Help:    "Print the syntax tree of each parsed Go file on stderr (for debugging)",
+		Handler: utils.SetFlag(&dumpAst),
+	},
+	utils.Option{
+		Long:    "include-readme-tags",
+		Help:    "Tag Go declarations in ```go code blocks of .md files",
+		Handler: utils.SetFlag(&readmeTags),
+	},
+	utils.Option{
+		Long:    "func-signature-refs",
+		Help:    "Record references to named types in function signatures in the references file",
+		Handler: utils.SetFlag(&funcSigRefs),
+	},
+	utils.Option{
+		Long:    "method-type-refs",
+		Help:    "Record references from methods to their receiver types in the references file",
+		Handler: utils.SetFlag(&methodTypeRefs),
+	},
+	utils.Option{
+		Long: "refs-output",
+		Help: fmt.Sprintf(
+			"`Filename` of references file, \"-\" for stdout, default \"%s\"", defaultRefsname),
+		Value:   true,
+		Handler: utils.SetString(&refsname),
+	},
+	utils.Option{
+		Long:    "null-output",
+		Help:    "Terminate each tagsection with a NUL byte, for streaming consumers",
+		Handler: utils.SetFlag(&nullOutput),
+	},
+	utils.Option{
+		Long:    "coalesce-fields",
+		Help:    "Warn about struct types of the same name with different fields in files of a directory",
+		Handler: utils.SetFlag(&coalesceFields),
+	},
+	utils.Option{
+		Long:       "packages",
+		Help:       "Tag the Go files of the packages matching the go list(1) `pattern`, eg \"./...\"",
+		Value:      true,
+		Repeatable: true,
+		Handler:    pushString(&packagePatterns),
+	},
+	utils.Option{
+		Long:    "filter-plugin",
+		Help:    "Shell `command` that selects the tags to keep, see below",
+		Value:   true,
+		Handler: utils.SetString(&filterPlugin),
+	},
+	utils.Option{
+		Long: "output-line-endings",
+		Help: fmt.Sprintf("Line `ending` of the output, \"lf\" or with --format=ctags \"crlf\", "+
+			"default \"%s\"", defaultLineEndings),
+		Value: true,
+		Handler: func(s string) error {
+			if s != "lf" && s != "crlf" {
+				return fmt.Errorf("Unknown line ending \"%s\"", s)
+			}
+			lineEndings = s
+			return nil
+		},
+	},
+	utils.Option{
+		Long: "on-parse-error",
+		Help: fmt.Sprintf(
+			"`Action` for Go files that cannot be parsed: \"fallback\" to the parsed parts, or\n"+
+				"	to etags-style parsing if there are none, \"builtin\" etags-style parsing,\n"+
+				"	\"skip\" the file, or \"fail\", default \"%s\"",
+			defaultOnParseError,
+		),
+		Value: true,
+		Handler: func(s string) error {
+			if s != "fallback" && s != "builtin" && s != "skip" && s != "fail" {
+				return fmt.Errorf("Unknown action \"%s\"", s)
+			}
+			onParseError = s
+			onParseErrorGiven = true
+			return nil
+		},
+	},
+	utils.Option{
+		Long: "suppress-section-for-errors",
+		Help: "Same as --on-parse-error=skip",
 		Handler: func(_ string) error {
-			members = false
+			onParseError = "skip"
+			onParseErrorGiven = true
+			return nil
+		},
+	},
+	utils.Option{
+		Long: "strict",
+		Help: "Never tag Go files that cannot be parsed with etags-style parsing: report them and\n" +
+			"	do not tag them at all, or with --on-parse-error=fail fail as usual",
+		Handler: utils.SetFlag(&strict),
+	},
+	utils.Option{
+		Long:    "debug-sections",
+		Help:    "`Filename` of a file that records the offset and origin of each section",
+		Value:   true,
+		Handler: utils.SetString(&debugSections),
+	},
+	utils.Option{
+		Long:    "tag-anonymous-funcs-by-position",
+		Help:    "Tag function literals assigned to exported vars and fields as func@file:line",
+		Handler: utils.SetFlag(&anonFuncs),
+	},
+	utils.Option{
+		Long: "format",
+		Help: fmt.Sprintf(
+			"`Format` of the tags file, \"etags\", \"ctags\" or \"json\", default \"%s\"",
+			defaultFormat,
+		),
+		Value: true,
+		Handler: func(s string) error {
+			if s != "etags" && s != "ctags" && s != "json" {
+				return fmt.Errorf("Unknown format \"%s\"", s)
+			}
+			format = s
+			return nil
+		},
+	},
+	utils.Option{
+		Long:    "json-lines",
+		Help:    "With --format=json, write one tag object per line instead of an array",
+		Handler: utils.SetFlag(&jsonLines),
+	},
+	utils.Option{
+		Long:    "relative",
+		Help:    "Emit relative input file names relative to the directory of the output file",
+		Handler: utils.SetFlag(&relative),
+	},
+	utils.Option{
+		Long: "jobs",
+		Help: fmt.Sprintf(
+			"`Number` of files to tag concurrently, 0 for one per CPU, default %d", defaultJobs),
+		Value: true,
+		Handler: func(s string) error {
+			if err := utils.SetInt(&jobs)(s); err != nil || jobs < 0 {
+				return fmt.Errorf("Bad number of jobs \"%s\"", s)
+			}
+			return nil
+		},
+	},
+	utils.Option{
+		Long:    "exported-only",
+		Help:    "Tag only exported Go names (and the package)",
+		Handler: utils.SetFlag(&exportedOnly),
+	},
+	utils.Option{
+		Long:    "qualified-members",
+		Help:    "Also tag members and methods as Type.Name",
+		Handler: utils.SetFlag(&qualifiedMembers),
+	},
+	utils.Option{
+		Long: "tags",
+		Help: "Comma-separated `list` of build tags, skip Go files excluded by build constraints\n" +
+			"	for the host GOOS and GOARCH and these tags",
+		Value: true,
+		Handler: func(s string) error {
+			buildTags = slices.DeleteFunc(strings.Split(s, ","), func(t string) bool { return t == "" })
+			return nil
+		},
+	},
+	utils.Option{
+		Long:    "include-generated",
+		Help:    "Tag Go files marked as generated (\"// Code generated ... DO NOT EDIT.\")",
+		Handler: utils.SetFlag(&includeGenerated),
+	},
+	utils.Option{
+		Long:    "per-dir",
+		Help:    "Write a tags file with the -o basename into the directory of each input file",
+		Handler: utils.SetFlag(&perDir),
+	},
+	utils.Option{
+		Long:    "incremental",
+		Help:    "Only retag the input files modified since the output file was written",
+		Handler: utils.SetFlag(&incremental),
+	},
+	utils.Option{
+		Long:    "stdin-name",
+		Help:    "Tag the Go or Python source on stdin as the file `name`, instead of input files",
+		Value:   true,
+		Handler: utils.SetString(&stdinName),
+	},
+	utils.Option{
+		Long:    "resolve-symlinks",
+		Help:    "Read and emit input files by the names of the files that symbolic links point to",
+		Handler: utils.SetFlag(&resolveSymlinks),
+	},
+	utils.Option{
+		Long:    "char-offsets",
+		Help:    "Emit tag offsets in characters rather than bytes, for files with multibyte text",
+		Handler: utils.SetFlag(&charOffsets),
+	},
+	utils.Option{
+		Long: "sort",
+		Help: fmt.Sprintf(
+			"`Order` of the tags in each section, \"name\", \"line\" or \"none\" for declaration\n"+
+				"	order, default \"%s\"",
+			defaultSortOrder,
+		),
+		Value: true,
+		Handler: func(s string) error {
+			if s != "name" && s != "line" && s != "none" {
+				return fmt.Errorf("Unknown sort order \"%s\"", s)
+			}
+			sortOrder = s
+			return nil
+		},
+	},
+	utils.Option{
+		Long:    "no-tests",
+		Help:    "Do not tag Go test files, those named *_test.go",
+		Handler: utils.SetFlag(&noTests),
+	},
+	utils.Option{
+		Long:    "only-tests",
+		Help:    "Tag only Go test files, those named *_test.go, among the Go files",
+		Handler: utils.SetFlag(&onlyTests),
+	},
+	utils.Option{
+		Long:    "stats",
+		Help:    "Print the numbers of files tagged in each way and of tags emitted on stderr",
+		Handler: utils.SetFlag(&showStats),
+	},
+	utils.Option{
+		Long:       "exclude",
+		Help:       "Skip the input files whose names match the `regexp`, even if included, repeatable",
+		Value:      true,
+		Repeatable: true,
+		Handler:    pushRegexp(&excludeRes),
+	},
+	utils.Option{
+		Long:       "include",
+		Help:       "Skip the input files whose names match no --include `regexp`, repeatable",
+		Value:      true,
+		Repeatable: true,
+		Handler:    pushRegexp(&includeRes),
+	},
+	utils.Option{
+		Long:    "header",
+		Help:    "Start the tags file with a line naming gotags, its version and the format",
+		Handler: utils.SetFlag(&header),
+	},
+	utils.Option{
+		Long: "members",
+		Help: fmt.Sprintf(
+			"Comma-separated `set` of the types whose members to tag, \"struct\" and \"interface\",\n"+
+				"	default \"%s\"",
+			defaultMembers,
+		),
+		Value: true,
+		Handler: func(s string) error {
+			members := kindSet(s)
+			for m := range members {
+				if !kindSet(defaultMembers)[m] {
+					return fmt.Errorf("Unknown member type \"%s\"", m)
+				}
+			}
+			structMembers = members["struct"]
+			interfaceMembers = members["interface"]
+			return nil
+		},
+	},
+	utils.Option{
+		Long:    "alias-targets",
+		Help:    "Also tag the type named by a type alias, at the alias",
+		Handler: utils.SetFlag(&aliasTargets),
+	},
+	utils.Option{
+		Long:    "dry-run",
+		Help:    "Report on stderr how each input file would be tagged, without writing any output",
+		Handler: utils.SetFlag(&dryRun),
+	},
+	utils.Option{
+		Long:    "respect-gitignore",
+		Help:    "With -R, skip the files and directories ignored by .gitignore files in the trees",
+		Handler: utils.SetFlag(&respectGitignore),
+	},
+	utils.Option{
+		Long: "lang-map",
+		Help: "Handle the files with extension .ext as `.ext=lang`, where lang is \"go\" or\n" +
+			"	\"python\", repeatable",
+		Value:      true,
+		Repeatable: true,
+		Handler: func(s string) error {
+			ext, lang, _ := strings.Cut(s, "=")
+			if len(ext) < 2 || ext[0] != '.' || langExt[lang] == "" {
+				return fmt.Errorf("Bad language mapping \"%s\"", s)
+			}
+			langMap[ext] = langExt[lang]
 			return nil
 		},
 	},
+	utils.Option{
+		Long: "preserve-order",
+		Help: "Emit the sections of the native etags in input order, not after all the others, at the\n" +
+			"	cost of running it more often",
+		Handler: utils.SetFlag(&preserveOrder),
+	},
+	utils.Option{
+		Long: "error-on-fallback",
+		Help: fmt.Sprintf(
+			"Exit with code %d after tagging if any Go file could not be parsed, listing the files",
+			exitFallback),
+		Handler: utils.SetFlag(&errorOnFallback),
+	},
+	utils.Option{
+		Long:    "deterministic",
+		Help:    "Tag the input files in sorted order of name, for the same output in any input order",
+		Handler: utils.SetFlag(&deterministic),
+	},
+	utils.Option{
+		Long:    "imports",
+		Help:    "Tag the local names of imported packages, as foo in import foo \"some/pkg\"",
+		Handler: utils.SetFlag(&importNames),
+	},
+	utils.Option{
+		Long: "output-directory",
+		Help: "`Directory`, created if need be, to write the output files into under the basenames\n" +
+			"	of -o and --refs-output, with input file names relative to it",
+		Value:   true,
+		Handler: utils.SetString(&outputDir),
+	},
+	utils.Option{
+		Long:       "exclude-dir",
+		Help:       "With -R, skip the directories with this base `name` as well as vendor, repeatable",
+		Value:      true,
+		Repeatable: true,
+		Handler:    pushString(&excludeDirs),
+	},
+	utils.Option{
+		Long:    "max-file-size",
+		Help:    "Skip the input files larger than this many `bytes`, default 0 for no limit",
+		Value:   true,
+		Handler: utils.SetInt(&maxFileSize),
+	},
+	utils.Option{
+		Long:    "timings",
+		Help:    "Print the time spent reading, parsing, emitting tags and in the native etags on stderr",
+		Handler: utils.SetFlag(&showTimings),
+	},
+	utils.Option{
+		Long:    "linknames",
+		Help:    "Tag the local names of //go:linkname directives, at the directives",
+		Handler: utils.SetFlag(&linknames),
+	},
+	utils.Option{
+		Long:    "no-offsets",
+		Help:    "Emit etags records with line numbers only, without offsets, for strict readers",
+		Handler: utils.SetFlag(&noOffsets),
+	},
+	utils.Option{
+		Long:    "enum-scope",
+		Help:    "With --format=ctags, give constants of a named type the scope enum:Type",
+		Handler: utils.SetFlag(&enumScope),
+	},
+	utils.Option{
+		Long:    "kind-filter-file",
+		Help:    "Read defaults for --kinds, --exclude and --include from the key=value lines of `file`",
+		Value:   true,
+		Handler: utils.SetString(&kindFilterFile),
+	},
+	utils.Option{
+		Long:    "merge-adjacent-sections",
+		Help:    "Merge the tags of a file that is input more than once into one section",
+		Handler: utils.SetFlag(&mergeSections),
+	},
 	utils.Option{
 		Short:      '-',
 		Repeatable: true,
-		Handler:    utils.SetFlag(&namesFromStdin),
+		Handler: func(string) error {
+			if namesFromStdin {
+				return fmt.Errorf("\"-\" given more than once, but stdin can be read only once")
+			}
+			namesFromStdin = true
+			inputFilenames = append(inputFilenames, "-")
+			return nil
+		},
 	},
 	utils.Option{
 		Value:      true,
@@ -162,20 +840,69 @@ var (
 )
 
 func main() {
+	// After the first signal a second one terminates gotags at once.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	interrupted = make(chan struct{})
+	go func() {
+		<-signals
+		signal.Stop(signals)
+		close(interrupted)
+	}()
 	os.Exit(runMain(os.Args[1:]))
 }
 
+// interrupted is closed when gotags receives SIGINT or SIGTERM.  Tagging then stops before the next
+// input file or native etags run, a partially written output file is removed (or truncated to its
+// old length with --append), and gotags exits with exitInterrupted.  It is nil, never closed, when
+// runMain is run by tests that do not set it.
+
+var interrupted chan struct{}
+
+const exitInterrupted = 130
+
+func isInterrupted() bool {
+	select {
+	case <-interrupted:
+		return true
+	default:
+		return false
+	}
+}
+
 // etags prints help and version on stdout, so we do too.
 
 func runMain(args []string) int {
 	// runMain() will be run multiple times in the same process by tests.
+	start := time.Now()
 	clearOptions()
+	stats = tagStats{}
+	timings = tagTimings{}
+	unparsedFiles = nil
 	rest, err := utils.GetOpts(opts, args)
 	if err != nil {
 		fmt.Fprintf(stderr, "Bad command line arguments: %s.  Try -h\n", err.Error())
 		return 2
 	}
-	inputFilenames = append(inputFilenames, rest...)
+	if kindFilterFile != "" {
+		if err := readKindFilterFile(kindFilterFile); err != nil {
+			fmt.Fprintf(stderr, "Bad kind filter file: %v\n", err)
+			return 1
+		}
+	}
+	inputFilenames, err = expandListFiles(append(inputFilenames, rest...))
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not read list file: %v\n", err)
+		return 1
+	}
+	if len(packagePatterns) > 0 {
+		files, err := listPackageFiles(packagePatterns)
+		if err != nil {
+			fmt.Fprintf(stderr, "Could not list packages: %v\n", err)
+			return 1
+		}
+		inputFilenames = append(inputFilenames, files...)
+	}
 	if help {
 		fmt.Fprintf(stdout, "Usage:\n\n")
 		fmt.Fprintf(stdout, "  gotags [options] input-filename ...\n\n")
@@ -191,88 +918,1735 @@ func runMain(args []string) int {
 		fmt.Fprintf(stdout, "gotags v%s (etags compatible)\n", VERSION)
 		return 0
 	}
+	if stdinName != "" {
+		if namesFromStdin || len(inputFilenames) > 0 {
+			fmt.Fprintf(stderr, "Confused input files.  Try -h\n")
+			return 2
+		}
+		if handleByExt[mappedExt(path.Ext(stdinName))] == nil {
+			fmt.Fprintf(stderr, "Only Go and Python source can be read from stdin.  Try -h\n")
+			return 2
+		}
+		inputFilenames = []string{stdinName}
+	}
 	if !namesFromStdin && len(inputFilenames) == 0 {
 		fmt.Fprintf(stderr, "No input files.  Try -h\n")
 		return 2
 	}
-	if namesFromStdin && len(inputFilenames) > 0 {
-		fmt.Fprintf(stderr, "Confused input files.  Try -h\n")
+	if incremental && (appendOutput || format != "etags" || filterPlugin != "" || mergeSections ||
+		funcSigRefs || methodTypeRefs) {
+		fmt.Fprintf(stderr, "--incremental only works with plain etags output.  Try -h\n")
+		return 2
+	}
+	// A JSON array or a sorted ctags file can't be extended by appending to it.
+	if appendOutput && format != "etags" {
+		fmt.Fprintf(stderr, "--append only works with etags output.  Try -h\n")
+		return 2
+	}
+	if header && format == "json" {
+		fmt.Fprintf(stderr, "--header does not work with --format=json.  Try -h\n")
+		return 2
+	}
+	if preserveOrder && (format != "etags" || filterPlugin != "" || mergeSections) {
+		fmt.Fprintf(stderr, "--preserve-order only works with plain etags output.  Try -h\n")
+		return 2
+	}
+	if noTests && onlyTests {
+		fmt.Fprintf(stderr, "--no-tests and --only-tests are mutually exclusive.  Try -h\n")
+		return 2
+	}
+	if lineEndings == "crlf" && format != "ctags" {
+		fmt.Fprintf(stderr, "CRLF line endings only work with --format=ctags, the etags format uses "+
+			"LF as a delimiter and CRLF would corrupt it.  Try -h\n")
+		return 2
+	}
+	if noOffsets && charOffsets {
+		fmt.Fprintf(stderr, "--no-offsets and --char-offsets are mutually exclusive.  Try -h\n")
 		return 2
 	}
+	if strict && onParseError != "skip" && onParseError != "fail" {
+		if onParseErrorGiven {
+			fmt.Fprintf(stderr, "--strict only works with --on-parse-error=skip or fail.  Try -h\n")
+			return 2
+		}
+		onParseError = "skip"
+	}
+	if noOffsets && format != "etags" {
+		fmt.Fprintf(stderr, "--no-offsets only works with etags output.  Try -h\n")
+		return 2
+	}
+	if outputDir != "" {
+		if outname == "-" || perDir {
+			fmt.Fprintf(stderr, "--output-directory does not work with stdout or --per-dir.  Try -h\n")
+			return 2
+		}
+		if !dryRun {
+			if err := os.MkdirAll(outputDir, 0777); err != nil {
+				fmt.Fprintf(stderr, "Could not create output directory: %v\n", err)
+				return 1
+			}
+		}
+		outname = filepath.Join(outputDir, filepath.Base(outname))
+		if refsname != "-" {
+			refsname = filepath.Join(outputDir, filepath.Base(refsname))
+		}
+		relative = true
+	}
 
 	var inputs iter.Seq[string]
+	var inputErr error
 	if namesFromStdin {
-		inputs = utils.GenerateLinesFromReader(stdin)
+		inputs = expandDirectories(
+			withStdinNames(inputFilenames, linesOf(stdin, &inputErr)), &inputErr)
 	} else {
-		inputs = slices.Values(inputFilenames)
+		inputs = expandDirectories(slices.Values(inputFilenames), &inputErr)
+	}
+	if resolveSymlinks && stdinName == "" {
+		inputs = resolvedNames(inputs)
+	}
+	if namesFromStdin && jobsStdin {
+		inputs = prefetch(inputs, prefetchLimit)
+	}
+	if deterministic {
+		inputs = sortedNames(inputs)
 	}
 
-	var output io.Writer
-	if outname == "-" {
-		output = stdout
-	} else {
-		file, err := os.Create(outname)
+	var sectionsLog io.Writer
+	if debugSections != "" && !dryRun {
+		file, err := os.Create(debugSections)
+		if err != nil {
+			fmt.Fprintf(stderr, "Could not create section log: %v\n", err)
+			return 1
+		}
+		defer file.Close()
+		sectionsLog = file
+	}
+
+	var status int
+	if perDir {
+		if outname == "-" {
+			fmt.Fprintf(stderr, "Cannot write per-directory tags files to stdout.  Try -h\n")
+			return 2
+		}
+		var dirs []string
+		dirInputs := make(map[string][]string)
+		for inputFn := range inputs {
+			dir := filepath.Dir(inputFn)
+			if _, found := dirInputs[dir]; !found {
+				dirs = append(dirs, dir)
+			}
+			dirInputs[dir] = append(dirInputs[dir], inputFn)
+		}
+		for _, dir := range dirs {
+			dirRefsname := refsname
+			if refsname != "-" {
+				dirRefsname = filepath.Join(dir, filepath.Base(refsname))
+			}
+			status = cmp.Or(status, writeTags(slices.Values(dirInputs[dir]),
+				filepath.Join(dir, filepath.Base(outname)), dirRefsname, true, sectionsLog, &inputErr))
+			if status == exitInterrupted {
+				break
+			}
+		}
+	} else {
+		status = writeTags(inputs, outname, refsname, relative, sectionsLog, &inputErr)
+	}
+	if status == exitInterrupted {
+		fmt.Fprintf(stderr, "Interrupted\n")
+		return status
+	}
+	if showStats {
+		stats.print()
+	}
+	if showTimings {
+		timings.print(time.Since(start))
+	}
+	if inputErr != nil {
+		fmt.Fprintf(stderr, "%v\n", inputErr)
+		return 1
+	}
+	if status == 0 && errorOnFallback && len(unparsedFiles) > 0 {
+		if !quiet {
+			fmt.Fprintf(stderr, "Go files that could not be parsed:\n")
+			for _, inputFn := range unparsedFiles {
+				fmt.Fprintf(stderr, "  %s\n", inputFn)
+			}
+		}
+		return exitFallback
+	}
+	return status
+}
+
+// With --kind-filter-file, each line of the file is key=value, where the key is kinds, exclude or
+// include and the value is as for the option of that name; exclude and include can be repeated.
+// Blank lines and lines starting with # are ignored.  The file gives defaults: a key is not used if
+// its option is given on the command line.
+
+func readKindFilterFile(filename string) error {
+	text, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var kinds string
+	var excludes, includes []*regexp.Regexp
+	for i, line := range strings.Split(string(text), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch {
+		case !found:
+			err = fmt.Errorf("no = in \"%s\"", line)
+		case key == "kinds":
+			kinds = value
+		case key == "exclude":
+			err = pushRegexp(&excludes)(value)
+		case key == "include":
+			err = pushRegexp(&includes)(value)
+		default:
+			err = fmt.Errorf("unknown key \"%s\"", key)
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", filename, i+1, err)
+		}
+	}
+	if kinds != "" && !kindsGiven {
+		if err := setKinds(kinds); err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+	if len(excludeRes) == 0 {
+		excludeRes = excludes
+	}
+	if len(includeRes) == 0 {
+		includeRes = includes
+	}
+	return nil
+}
+
+// For --error-on-fallback, unparsedFiles are the Go files that could not be parsed and so were
+// tagged in part, or by the builtin patterns, or not at all.
+
+var unparsedFiles []string
+
+const exitFallback = 3
+
+// For --stats, stats counts the input files by how they were tagged, or that they were skipped or
+// their sections reused, and the tags emitted.  For the native etags the tags are counted from the
+// lines of its output.
+
+type tagStats struct {
+	parsed, builtin, native, skipped, reused, tags int
+}
+
+var stats tagStats
+
+func (s *tagStats) print() {
+	fmt.Fprintf(stderr, "Files tagged by the Go parser: %d\n", s.parsed)
+	fmt.Fprintf(stderr, "Files tagged by builtin patterns: %d\n", s.builtin)
+	fmt.Fprintf(stderr, "Files tagged by the native etags: %d\n", s.native)
+	fmt.Fprintf(stderr, "Files skipped: %d\n", s.skipped)
+	fmt.Fprintf(stderr, "Files reused from the previous tags file: %d\n", s.reused)
+	fmt.Fprintf(stderr, "Tags emitted: %d\n", s.tags)
+}
+
+// For --timings, timings accumulates the time spent in each phase of tagging.  Files can be read
+// and parsed by several goroutines at once, so those times are summed over the goroutines and can
+// exceed the total.
+
+type tagTimings struct {
+	read, parse, emit, native atomic.Int64
+}
+
+var timings tagTimings
+
+func (s *tagTimings) add(d *atomic.Int64, start time.Time) {
+	d.Add(int64(time.Since(start)))
+}
+
+func (s *tagTimings) print(total time.Duration) {
+	show := func(d time.Duration) time.Duration {
+		return d.Round(time.Microsecond)
+	}
+	fmt.Fprintf(stderr, "Total time: %v\n", show(total))
+	fmt.Fprintf(stderr, "Time reading files: %v\n", show(time.Duration(s.read.Load())))
+	fmt.Fprintf(stderr, "Time parsing Go: %v\n", show(time.Duration(s.parse.Load())))
+	fmt.Fprintf(stderr, "Time emitting tags: %v\n", show(time.Duration(s.emit.Load())))
+	fmt.Fprintf(stderr, "Time in the native etags: %v\n", show(time.Duration(s.native.Load())))
+}
+
+// writeTags tags the inputs into the tags file outname and, if references are requested, the
+// references file refsname.  With relativeNames, input file names are emitted relative to the
+// directories of these files.  If reading the inputs fails, the error is left in inputErr and the
+// status is 1, and an existing tags file is left untouched.
+
+func writeTags(
+	inputs iter.Seq[string],
+	outname, refsname string,
+	relativeNames bool,
+	sectionsLog io.Writer,
+	inputErr *error,
+) int {
+	previous = nil
+	if incremental && outname != "-" {
+		if info, err := os.Stat(outname); err == nil {
+			text, err := os.ReadFile(outname)
+			if err != nil {
+				fmt.Fprintf(stderr, "Could not read output file: %v\n", err)
+				return 1
+			}
+			previous = &previousTags{readSections(string(text)), info.ModTime()}
+		}
+	}
+
+	// Every section starts with its own header, so appending sections to an existing tags file
+	// yields a valid tags file.  The offset is where the new output starts in the file.  A new tags
+	// file replaces an old regular file only once it is complete.  With --dry-run nothing is
+	// written.
+	var output io.Writer
+	var offset int64
+	var newFile *atomicFile
+	var appendFile *os.File
+	if dryRun {
+		output = io.Discard
+	} else if outname == "-" {
+		output = stdout
+	} else if appendOutput {
+		file, err := os.OpenFile(outname, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			fmt.Fprintf(stderr, "Could not create output file: %v\n", err)
+			return 1
+		}
+		defer file.Close()
+		if info, err := file.Stat(); err == nil {
+			offset = info.Size()
+		}
+		appendFile = file
+		output = file
+	} else if info, err := os.Lstat(outname); err == nil && !info.Mode().IsRegular() {
+		// Not a tags file to be replaced but eg /dev/null or a symlink.
+		file, err := os.Create(outname)
 		if err != nil {
 			fmt.Fprintf(stderr, "Could not create output file: %v\n", err)
 			return 1
 		}
 		defer file.Close()
 		output = file
+	} else {
+		file, err := createAtomic(outname)
+		if err != nil {
+			fmt.Fprintf(stderr, "Could not create output file: %v\n", err)
+			return 1
+		}
+		defer file.abort()
+		newFile = file
+		output = file
+	}
+
+	var sections *sectionLog
+	if sectionsLog != nil {
+		counter := &countingWriter{w: output, n: offset}
+		output = counter
+		sections = &sectionLog{sectionsLog, counter}
+	}
+
+	// Emacs ignores everything before the first tagsection, so the BOM is harmless to it.  It would
+	// not be harmless in the middle of the file.
+	if outputBom && offset == 0 {
+		fmt.Fprint(output, tags.ByteOrderMark)
+	}
+	// The header is likewise ignored, and for ctags it is made of pseudo-tags, which sort first.
+	if header && offset == 0 {
+		if format == "ctags" {
+			fmt.Fprintf(output, "!_TAG_PROGRAM_NAME\tgotags\t//%s!_TAG_PROGRAM_VERSION\t%s\t//%s",
+				ctagsEOL(), VERSION, ctagsEOL())
+		} else {
+			fmt.Fprintf(output, "gotags %s format=%s\n", VERSION, format)
+		}
+	}
+
+	// The references file is likewise replaced only once it is complete.
+	var refsOutput io.Writer
+	var refsFile *atomicFile
+	if funcSigRefs || methodTypeRefs {
+		if dryRun {
+			refsOutput = io.Discard
+		} else if refsname == "-" {
+			refsOutput = stdout
+		} else if info, err := os.Lstat(refsname); err == nil && !info.Mode().IsRegular() {
+			file, err := os.Create(refsname)
+			if err != nil {
+				fmt.Fprintf(stderr, "Could not create references file: %v\n", err)
+				return 1
+			}
+			defer file.Close()
+			refsOutput = file
+		} else {
+			file, err := createAtomic(refsname)
+			if err != nil {
+				fmt.Fprintf(stderr, "Could not create references file: %v\n", err)
+				return 1
+			}
+			defer file.abort()
+			refsFile = file
+			refsOutput = file
+		}
+	}
+
+	tagsDir, refsDir = "", ""
+	if relativeNames {
+		if outname != "-" {
+			tagsDir = filepath.Dir(outname)
+		}
+		if refsname != "-" {
+			refsDir = filepath.Dir(refsname)
+		}
+	}
+
+	status := computeTags(inputs, output, refsOutput, sections)
+	if status == 0 && *inputErr != nil {
+		status = 1
+	}
+	if status == exitInterrupted && appendFile != nil {
+		appendFile.Truncate(offset)
+	}
+	if status == 0 && newFile != nil {
+		if err := newFile.commit(); err != nil {
+			fmt.Fprintf(stderr, "Could not write output file: %v\n", err)
+			return 1
+		}
+	}
+	if status == 0 && refsFile != nil {
+		if err := refsFile.commit(); err != nil {
+			fmt.Fprintf(stderr, "Could not write references file: %v\n", err)
+			return 1
+		}
+	}
+	return status
+}
+
+// An atomicFile is written as a temporary file in the directory of the target file, which it
+// replaces when committed.  If it is aborted instead, the target file is untouched.
+
+type atomicFile struct {
+	*os.File
+	target    string
+	committed bool
+}
+
+func createAtomic(target string) (*atomicFile, error) {
+	file, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".*")
+	if err != nil {
+		return nil, err
+	}
+	// CreateTemp makes the file private, but it should be like the file it replaces.
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(target); err == nil {
+		mode = info.Mode().Perm()
+	}
+	file.Chmod(mode)
+	return &atomicFile{File: file, target: target}, nil
+}
+
+func (a *atomicFile) commit() error {
+	a.committed = true
+	err := a.Close()
+	if err == nil {
+		err = os.Rename(a.Name(), a.target)
+	}
+	if err != nil {
+		os.Remove(a.Name())
+	}
+	return err
+}
+
+func (a *atomicFile) abort() {
+	if !a.committed {
+		a.Close()
+		os.Remove(a.Name())
+	}
+}
+
+// expandListFiles replaces each name of the form @listfile by the file names listed in listfile, one
+// per line.  Blank lines and lines starting with # are ignored.
+
+func expandListFiles(names []string) ([]string, error) {
+	expanded := make([]string, 0, len(names))
+	for _, name := range names {
+		listFn, found := strings.CutPrefix(name, "@")
+		if !found {
+			expanded = append(expanded, name)
+			continue
+		}
+		file, err := os.Open(listFn)
+		if err != nil {
+			return nil, err
+		}
+		for line, err := range utils.GenerateLinesFromReader(file) {
+			if err != nil {
+				file.Close()
+				return nil, fmt.Errorf("%s: %w", listFn, err)
+			}
+			line = strings.TrimRight(line, "\r")
+			if trimmed := strings.TrimSpace(line); trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+				expanded = append(expanded, line)
+			}
+		}
+		file.Close()
+	}
+	return expanded, nil
+}
+
+// withStdinNames yields the names, with the "-" among them replaced by the names in stdinNames.
+
+func withStdinNames(names []string, stdinNames iter.Seq[string]) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for _, name := range names {
+			if name != "-" {
+				if !yield(name) {
+					return
+				}
+				continue
+			}
+			for stdinName := range stdinNames {
+				if !yield(stdinName) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// linesOf yields the lines of input, or with --null its NUL-terminated strings, stopping at the first
+// read error (typically a line that is too long) and storing it in *errp.
+
+func linesOf(input io.Reader, errp *error) iter.Seq[string] {
+	generate := utils.GenerateLinesFromReader
+	if nullInput {
+		generate = utils.GenerateNulSeparatedFromReader
+	}
+	return func(yield func(string) bool) {
+		for line, err := range generate(input) {
+			if err != nil {
+				*errp = fmt.Errorf("Could not read file names: %w", err)
+				return
+			}
+			if !yield(line) {
+				return
+			}
+		}
+	}
+}
+
+// expandDirectories yields the names, except that with --recursive a directory name (or a name of the
+// form dir/...) is replaced by the names of the files in its tree that gotags handles itself,
+// skipping vendor, hidden and --exclude-dir directories, and with --respect-gitignore the paths
+// ignored by the .gitignore files in the tree.  Without --recursive a directory name is an error,
+// which stops the iteration and is stored in *errp.
+
+func expandDirectories(names iter.Seq[string], errp *error) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for name := range names {
+			if recursive && strings.HasSuffix(name, "/...") {
+				name = strings.TrimSuffix(name, "/...")
+			}
+			info, err := os.Stat(name)
+			if err != nil || !info.IsDir() {
+				if !yield(name) {
+					return
+				}
+				continue
+			}
+			if !recursive {
+				*errp = fmt.Errorf("%s is a directory, use -R to tag the files in it", name)
+				return
+			}
+			stopped := false
+			ignores := make(map[string]*gitignore.Patterns)
+			filepath.WalkDir(name, func(fn string, d fs.DirEntry, err error) error {
+				if err != nil {
+					if !quiet {
+						fmt.Fprintf(stderr, "Skipping %s: %v\n", fn, err)
+					}
+					return nil
+				}
+				if d.IsDir() {
+					base := d.Name()
+					if fn != name && (base == "vendor" || strings.HasPrefix(base, ".") ||
+						slices.Contains(excludeDirs, base)) {
+						return filepath.SkipDir
+					}
+					if respectGitignore && fn != name && gitignored(ignores, fn, true) {
+						return filepath.SkipDir
+					}
+					if respectGitignore {
+						if text, err := os.ReadFile(filepath.Join(fn, ".gitignore")); err == nil {
+							ignores[filepath.Clean(fn)] = gitignore.Parse(string(text))
+						}
+					}
+					return nil
+				}
+				if handleByExt[mappedExt(path.Ext(strings.TrimSuffix(fn, ".gz")))] == nil {
+					return nil
+				}
+				if respectGitignore && gitignored(ignores, fn, false) {
+					return nil
+				}
+				if !yield(fn) {
+					stopped = true
+					return filepath.SkipAll
+				}
+				return nil
+			})
+			if stopped {
+				return
+			}
+		}
+	}
+}
+
+// gitignored reports whether the path is ignored by the .gitignore files read so far from the
+// directories above it, where the file nearest the path that has a matching pattern decides.
+
+func gitignored(ignores map[string]*gitignore.Patterns, fn string, isDir bool) bool {
+	for dir := filepath.Dir(fn); ; dir = filepath.Dir(dir) {
+		if g := ignores[dir]; g != nil {
+			rel, err := filepath.Rel(dir, fn)
+			if err != nil {
+				return false
+			}
+			if matched, ignored := g.Match(filepath.ToSlash(rel), isDir); matched {
+				if ignored && verbose {
+					fmt.Fprintf(stdout, "Skipping by .gitignore: %s\n", fn)
+				}
+				return ignored
+			}
+		}
+		if dir == filepath.Dir(dir) {
+			return false
+		}
+	}
+}
+
+// sortedNames yields the names in sorted order, once it has seen them all.
+
+func sortedNames(names iter.Seq[string]) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for _, name := range slices.Sorted(names) {
+			if !yield(name) {
+				return
+			}
+		}
+	}
+}
+
+// resolvedNames yields the names with symbolic links resolved, skipping names that cannot be
+// resolved, such as broken links.
+
+func resolvedNames(names iter.Seq[string]) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for name := range names {
+			resolved, err := filepath.EvalSymlinks(name)
+			if err != nil {
+				if !quiet {
+					fmt.Fprintf(stderr, "Skipping %s: %v\n", name, err)
+				}
+				continue
+			}
+			if !yield(resolved) {
+				return
+			}
+		}
+	}
+}
+
+// For --debug-sections, a sectionLog records on w the byte offset in the output, the origin (the
+// means by which the tags were found: gotags, builtin, or native) and the file name of each section
+// as it is written, one tab-separated line per section.
+
+type sectionLog struct {
+	w   io.Writer
+	out *countingWriter
+}
+
+func (l *sectionLog) log(origin, inputFn string, offset int64) {
+	if l != nil {
+		fmt.Fprintf(l.w, "%d\t%s\t%s\n", l.out.n+offset, origin, inputFn)
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// The go command knows exactly which files make up a package in the current build context, so let it
+// resolve package patterns.  This is also what golang.org/x/tools/go/packages does.  Test files and
+// files excluded by build constraints are not included.  Names below the current directory are made
+// relative to it.
+
+func listPackageFiles(patterns []string) ([]string, error) {
+	cmd := exec.Command(
+		"go",
+		append([]string{"list", "-e", "-f", `{{range .GoFiles}}{{$.Dir}}/{{.}}
+{{end}}{{range .CgoFiles}}{{$.Dir}}/{{.}}
+{{end}}`}, patterns...)...,
+	)
+	var subStderr strings.Builder
+	cmd.Stderr = &subStderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(subStderr.String()))
+	}
+	wd, _ := os.Getwd()
+	files := make([]string, 0)
+	for _, fn := range strings.Split(string(out), "\n") {
+		if fn == "" {
+			continue
+		}
+		if rel, err := filepath.Rel(wd, fn); err == nil && filepath.IsLocal(rel) {
+			fn = rel
+		}
+		files = append(files, fn)
+	}
+	return files, nil
+}
+
+// A slow producer on stdin (eg find(1) still running) should not stall tagging of the names it has
+// already produced, nor should tagging stall the producer.  The bounded channel caps how far
+// reading can run ahead of tagging.
+
+const prefetchLimit = 256
+
+func prefetch(names iter.Seq[string], limit int) iter.Seq[string] {
+	ch := make(chan string, limit)
+	go func() {
+		for name := range names {
+			ch <- name
+		}
+		close(ch)
+	}()
+	return func(yield func(string) bool) {
+		for name := range ch {
+			if !yield(name) {
+				// Drain so that the producer can finish.
+				for range ch {
+				}
+				return
+			}
+		}
+	}
+}
+
+var handleByExt = map[string]func(fn, text string, ft *fileTags){
+	".go": handleGo,
+	".py": handlePython,
+}
+
+// With --lang-map, files with other extensions are handled as if they had the extension of the
+// language they are mapped to.
+
+var langExt = map[string]string{
+	"go":     ".go",
+	"python": ".py",
+}
+
+func mappedExt(ext string) string {
+	if mapped, found := langMap[ext]; found {
+		return mapped
+	}
+	return ext
+}
+
+// A tag is one tagdef of a tagsection.
+
+type tag = tags.Tag
+
+// References are not definitions and so do not belong in the tags file, but they are useful for
+// navigation.  They are written to a separate file in the same format as the tags file, one section
+// per input file that has references.
+//
+// If previous is set then it is the file's unchanged section from the previous tags file, see
+// --incremental.  If suppressed is set then the file gets no section at all (generated is also set
+// if that is because it is a generated file), and if failed is set then processing must stop with
+// an error.  Unparsed is set for a Go file that could not be parsed, whatever became of it.
+//
+// Each file has its own FileSet, so that files can be tagged concurrently.  For the same reason,
+// what tagging the file prints is collected in stdout and stderr and printed by the collector, in
+// input order, see tagFiles.
+
+type fileTags struct {
+	fset       *token.FileSet
+	stdout     bytes.Buffer
+	stderr     bytes.Buffer
+	origin     string
+	tags       []tag
+	refs       []tag
+	structs    []tags.Struct
+	previous   string
+	suppressed bool
+	generated  bool
+	failed     bool
+	unparsed   bool
+}
+
+// flush prints what tagging the file printed.
+
+func (ft *fileTags) flush() {
+	if ft != nil {
+		stdout.Write(ft.stdout.Bytes())
+		stderr.Write(ft.stderr.Bytes())
+	}
+}
+
+// add adds the tags, references and struct types computed by the tags package.
+
+func (ft *fileTags) add(r *tags.File) {
+	ft.tags = append(ft.tags, r.Tags...)
+	ft.refs = append(ft.refs, r.Refs...)
+	if coalesceFields {
+		ft.structs = append(ft.structs, r.Structs...)
+	}
+}
+
+type section struct {
+	inputFn string
+	origin  string
+	tags    []tag
+}
+
+func computeTags(
+	inputs iter.Seq[string],
+	output, refsOutput io.Writer,
+	sections *sectionLog,
+) int {
+	unhandledFiles := make([]string, 0)
+	generatedFiles := 0
+	excludedFiles := 0
+	defer func() {
+		if verbose && generatedFiles > 0 {
+			fmt.Fprintf(stdout, "Skipped %d generated files\n", generatedFiles)
+		}
+		if verbose && excludedFiles > 0 {
+			fmt.Fprintf(stdout, "Skipped %d files by --exclude or --include\n", excludedFiles)
+		}
+		stats.skipped += excludedFiles
+	}()
+	structFields = make(map[structKey]structInfo)
+	var tagsJSON *jsonWriter
+	if format == "json" {
+		tagsJSON = &jsonWriter{w: output}
+	}
+	emitSection := func(s section) {
+		defer timings.add(&timings.emit, time.Now())
+		sortTags(s.tags)
+		if tagsJSON != nil {
+			tagsJSON.write(s)
+			stats.tags += len(s.tags)
+			return
+		}
+		sections.log(s.origin, s.inputFn, 0)
+		stats.tags += writeSection(output, s.inputFn, s.tags)
+		if nullOutput {
+			fmt.Fprint(output, "\x00")
+		}
+	}
+	// Output is streamed: no more than one file's tags are held in memory at a time, and the output
+	// of the native etags is copied as it arrives.  The exceptions are that with a filter plugin all
+	// sections are held back until the plugin has seen all the tags, and when merging sections or
+	// sorting ctags output they are held back until all the files have been seen.
+	ctags := format == "ctags"
+	holdBack := filterPlugin != "" || mergeSections || ctags
+	var pending []section
+	pendingIx := make(map[string]int)
+	// The files for the native etags are tagged after all the others, unless --preserve-order is
+	// given, in which case each run of consecutive such files is tagged before the next file that
+	// gotags tags itself.
+	nativeStatus := 0
+	runNative := func() {
+		if len(unhandledFiles) == 0 || systemEtagsCommand == "" {
+			return
+		}
+		stats.native += len(unhandledFiles)
+		if dryRun {
+			for _, inputFn := range unhandledFiles {
+				fmt.Fprintf(stderr, "%s: native\n", inputFn)
+			}
+		} else {
+			start := time.Now()
+			nativeStatus = cmp.Or(nativeStatus, systemEtags(unhandledFiles, output, sections))
+			timings.add(&timings.native, start)
+		}
+		unhandledFiles = unhandledFiles[:0]
+	}
+	// A file that is input more than once is tagged once, or with --merge-adjacent-sections tagged
+	// each time and its tags merged into one section.
+	names := selectedNames(inputs, &excludedFiles)
+	if !mergeSections {
+		names = uniqueNames(names)
+	}
+	for inputFn, ft := range tagFiles(names) {
+		if isInterrupted() {
+			return exitInterrupted
+		}
+		if ft == nil {
+			unhandledFiles = append(unhandledFiles, inputFn)
+			continue
+		}
+		if preserveOrder {
+			runNative()
+		}
+		if dryRun {
+			switch {
+			case ft.previous != "":
+				fmt.Fprintf(stderr, "%s: reused\n", inputFn)
+			case ft.suppressed:
+				fmt.Fprintf(stderr, "%s: skipped\n", inputFn)
+			case !ft.failed:
+				fmt.Fprintf(stderr, "%s: %s, %d tags\n", inputFn, ft.origin, len(ft.tags))
+			}
+		}
+		if ft.previous != "" {
+			sections.log("previous", inputFn, 0)
+			fmt.Fprint(output, ft.previous)
+			stats.reused++
+			continue
+		}
+		if ft.unparsed {
+			unparsedFiles = append(unparsedFiles, inputFn)
+		}
+		if ft.failed {
+			return 1
+		}
+		if ft.generated {
+			generatedFiles++
+		}
+		if ft.suppressed {
+			stats.skipped++
+			continue
+		}
+		if ft.origin == "builtin" {
+			stats.builtin++
+		} else {
+			stats.parsed++
+		}
+		for _, sd := range ft.structs {
+			checkStructFields(inputFn, sd.Name, sd.Type)
+		}
+
+		s := section{outputName(tagsDir, inputFn), ft.origin, ft.tags}
+		if !holdBack {
+			emitSection(s)
+		} else if ix, found := pendingIx[filepath.Clean(inputFn)]; found && mergeSections {
+			for _, t := range s.tags {
+				if !slices.Contains(pending[ix].tags, t) {
+					pending[ix].tags = append(pending[ix].tags, t)
+				}
+			}
+		} else {
+			pendingIx[filepath.Clean(inputFn)] = len(pending)
+			pending = append(pending, s)
+		}
+		if refsOutput != nil && len(ft.refs) > 0 {
+			start := time.Now()
+			writeSection(refsOutput, outputName(refsDir, inputFn), ft.refs)
+			timings.add(&timings.emit, start)
+		}
+	}
+	if isInterrupted() {
+		return exitInterrupted
+	}
+	if filterPlugin != "" {
+		if err := filterTags(pending); err != nil {
+			fmt.Fprintf(stderr, "Filter plugin failed: %v\n", err)
+			return 1
+		}
+	}
+	if ctags {
+		for _, s := range pending {
+			stats.tags += len(s.tags)
+		}
+		start := time.Now()
+		writeCtags(output, pending)
+		timings.add(&timings.emit, start)
+	} else {
+		for _, s := range pending {
+			emitSection(s)
+		}
+	}
+	if format != "etags" {
+		if tagsJSON != nil {
+			tagsJSON.close()
+		}
+		if len(unhandledFiles) > 0 && !quiet {
+			fmt.Fprintf(stderr, "Not tagging %d files without Go or Python syntax in %s format\n",
+				len(unhandledFiles), format)
+		}
+		stats.skipped += len(unhandledFiles)
+		return 0
+	}
+	runNative()
+	stats.skipped += len(unhandledFiles)
+	return nativeStatus
+}
+
+// selectedNames yields the names that match no --exclude pattern and, if there are --include
+// patterns, match one of them.  Exclusion wins over inclusion.  Names that are not yielded are
+// counted in *excluded.
+
+func selectedNames(names iter.Seq[string], excluded *int) iter.Seq[string] {
+	if len(excludeRes) == 0 && len(includeRes) == 0 {
+		return names
+	}
+	matches := func(res []*regexp.Regexp, name string) bool {
+		return slices.ContainsFunc(res, func(re *regexp.Regexp) bool { return re.MatchString(name) })
+	}
+	return func(yield func(string) bool) {
+		for name := range names {
+			if matches(excludeRes, name) || len(includeRes) > 0 && !matches(includeRes, name) {
+				*excluded++
+				continue
+			}
+			if !yield(name) {
+				return
+			}
+		}
+	}
+}
+
+// uniqueNames yields the names that have not been seen before, after cleaning, with a warning for
+// each duplicate.
+
+func uniqueNames(names iter.Seq[string]) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		seen := make(map[string]bool)
+		for name := range names {
+			clean := filepath.Clean(name)
+			if seen[clean] {
+				if !quiet {
+					fmt.Fprintf(stderr, "Skipping duplicate input file %s\n", name)
+				}
+				continue
+			}
+			seen[clean] = true
+			if !yield(name) {
+				return
+			}
+		}
+	}
+}
+
+// tagFile reads and tags one input file.  It returns nil if the file is not handled by gotags itself.
+// A file that cannot be read, or that is too large for --max-file-size, is suppressed, even if it
+// would be passed to the native etags.  A gzip-compressed file, with extension .gz, is handled
+// according to the extension before .gz and tagged with line numbers and offsets in the
+// decompressed text.
+
+func tagFile(inputFn string) *fileTags {
+	if text, found := previous.lookup(inputFn); found {
+		return &fileTags{previous: text}
+	}
+	if maxFileSize > 0 && inputFn != stdinName {
+		if info, err := os.Stat(inputFn); err == nil && info.Size() > int64(maxFileSize) {
+			ft := &fileTags{suppressed: true}
+			if !quiet {
+				fmt.Fprintf(&ft.stderr, "Skipping %s: larger than %d bytes\n", inputFn, maxFileSize)
+			}
+			return ft
+		}
+	}
+	ext := path.Ext(inputFn)
+	compressed := ext == ".gz"
+	if compressed {
+		ext = path.Ext(strings.TrimSuffix(inputFn, ext))
+	}
+	ext = mappedExt(ext)
+	handler := handleByExt[ext]
+	if handler == nil && ext == ".md" && readmeTags {
+		handler = handleMarkdown
+	}
+	if handler == nil {
+		return nil
+	}
+	ft := &fileTags{fset: token.NewFileSet()}
+	if isTest := strings.HasSuffix(strings.TrimSuffix(inputFn, ".gz"), "_test.go"); ext == ".go" &&
+		(noTests && isTest || onlyTests && !isTest) {
+		if verbose {
+			fmt.Fprintf(&ft.stdout, "Skipping by --no-tests or --only-tests: %s\n", inputFn)
+		}
+		ft.suppressed = true
+		return ft
+	}
+	start := time.Now()
+	inputBytes, err := readInput(inputFn)
+	if err == nil && compressed {
+		inputBytes, err = gunzip(inputBytes)
+	}
+	timings.add(&timings.read, start)
+	if err != nil {
+		if !quiet {
+			fmt.Fprintf(&ft.stderr, "Skipping %s: %v\n", inputFn, err)
+		}
+		ft.suppressed = true
+		return ft
+	}
+	if ext == ".go" && buildTags != nil && !matchBuildContext(inputFn, string(inputBytes)) {
+		if verbose {
+			fmt.Fprintf(&ft.stdout, "Excluded by build constraints: %s\n", inputFn)
+		}
+		ft.suppressed = true
+		return ft
+	}
+	if ext == ".go" && !includeGenerated && isGenerated(string(inputBytes)) {
+		if verbose {
+			fmt.Fprintf(&ft.stdout, "Skipping generated file: %s\n", inputFn)
+		}
+		ft.suppressed = true
+		ft.generated = true
+		return ft
+	}
+	inputText := string(inputBytes)
+	handler(inputFn, inputText, ft)
+	sanitizePatterns(&ft.stdout, inputFn, ft.tags)
+	sanitizePatterns(&ft.stdout, inputFn, ft.refs)
+	if charOffsets {
+		toCharOffsets(inputText, ft.tags)
+		toCharOffsets(inputText, ft.refs)
+	}
+	if noOffsets {
+		dropOffsets(ft.tags)
+		dropOffsets(ft.refs)
+	}
+	return ft
+}
+
+// The control characters that delimit the parts of a tagsection can't appear in a pattern, but a
+// source line can contain them, for example a form feed in a comment or in Python indentation.
+// They are replaced by spaces, so that the pattern keeps its length and still ends with the name.
+
+var patternControls = strings.NewReplacer("\x01", " ", "\x0C", " ", "\x7F", " ")
+
+func sanitizePatterns(w io.Writer, inputFn string, ts []tag) {
+	for i := range ts {
+		if strings.ContainsAny(ts[i].Pattern, "\x01\x0C\x7F") {
+			if verbose {
+				fmt.Fprintf(w, "Replacing control characters in pattern for %s in %s\n",
+					ts[i].Name, inputFn)
+			}
+			ts[i].Pattern = patternControls.Replace(ts[i].Pattern)
+		}
+	}
+}
+
+// toCharOffsets converts the byte offsets of tags into text to character offsets, for
+// --char-offsets.  The tags are mostly in order of increasing offset, so the count continues from
+// the previous tag when it can.
+
+func toCharOffsets(text string, ts []tag) {
+	byteOffs, charOffs := 0, 0
+	for i := range ts {
+		offs := ts[i].Offset
+		if offs < 0 {
+			continue
+		}
+		if offs < byteOffs {
+			byteOffs, charOffs = 0, 0
+		}
+		charOffs += utf8.RuneCountInString(text[byteOffs:offs])
+		byteOffs = offs
+		ts[i].Offset = charOffs
+		ts[i].EndOffset = charOffs + utf8.RuneCountInString(ts[i].Pattern)
+	}
+}
+
+// dropOffsets removes the offsets from tags, for --no-offsets.
+
+func dropOffsets(ts []tag) {
+	for i := range ts {
+		ts[i].Offset = -1
+		ts[i].EndOffset = -1
 	}
+}
+
+// With --stdin-name, the text of the input file of that name is read from stdin.
 
-	return computeTags(inputs, output)
+func readInput(inputFn string) ([]byte, error) {
+	if stdinName != "" && inputFn == stdinName {
+		return io.ReadAll(stdin)
+	}
+	return os.ReadFile(inputFn)
 }
 
-var handleByExt = map[string]func(fn, text string, output io.Writer){
-	".go": handleGo,
-	".py": handlePython,
+func gunzip(compressed []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
 }
 
-func computeTags(inputs iter.Seq[string], output io.Writer) int {
-	unhandledFiles := make([]string, 0)
-	for inputFn := range inputs {
-		handler := handleByExt[path.Ext(inputFn)]
-		if handler == nil {
-			unhandledFiles = append(unhandledFiles, inputFn)
+// With --tags, a Go file is tagged only if it satisfies the build context of the host GOOS and
+// GOARCH (as seen by the go command) and the given build tags: both its file name, in the
+// name_GOOS_GOARCH convention, and its //go:build line must be satisfied.  The lists of operating
+// systems and architectures are those of go/build.
+
+var (
+	knownOS = setOf("aix android darwin dragonfly freebsd hurd illumos ios js linux nacl netbsd " +
+		"openbsd plan9 solaris wasip1 windows zos")
+	unixOS = setOf("aix android darwin dragonfly freebsd hurd illumos ios linux netbsd openbsd " +
+		"solaris")
+	knownArch = setOf("386 amd64 amd64p32 arm armbe arm64 arm64be loong64 mips mipsle mips64 " +
+		"mips64le mips64p32 mips64p32le ppc ppc64 ppc64le riscv riscv64 s390 s390x sparc sparc64 wasm")
+)
+
+// buildContext supplies GOOS, GOARCH and the other properties of the host for build constraints,
+// and is a variable so that tests can evaluate them for other hosts.
+
+var buildContext = &build.Default
+
+func setOf(words string) map[string]bool {
+	set := make(map[string]bool)
+	for _, w := range strings.Fields(words) {
+		set[w] = true
+	}
+	return set
+}
+
+func matchBuildTag(tag string) bool {
+	goos := buildContext.GOOS
+	switch {
+	case tag == goos || tag == buildContext.GOARCH || tag == buildContext.Compiler:
+		return true
+	case tag == "unix":
+		return unixOS[goos]
+	case tag == "linux" && goos == "android", tag == "solaris" && goos == "illumos",
+		tag == "darwin" && goos == "ios":
+		return true
+	case tag == "cgo":
+		return buildContext.CgoEnabled
+	}
+	return slices.Contains(buildContext.ReleaseTags, tag) || slices.Contains(buildTags, tag)
+}
+
+func matchBuildContext(inputFn, inputText string) bool {
+	name := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(inputFn), ".gz"), ".go")
+	if _, suffixes, found := strings.Cut(name, "_"); found {
+		l := strings.Split(suffixes, "_")
+		if len(l) > 1 && l[len(l)-1] == "test" {
+			l = l[:len(l)-1]
+		}
+		n := len(l)
+		if n >= 2 && knownOS[l[n-2]] && knownArch[l[n-1]] {
+			if !matchBuildTag(l[n-2]) || !matchBuildTag(l[n-1]) {
+				return false
+			}
+		} else if knownOS[l[n-1]] || knownArch[l[n-1]] {
+			if !matchBuildTag(l[n-1]) {
+				return false
+			}
+		}
+	}
+	// The //go:build line must precede the package clause, among other comments and blank lines.
+	for _, line := range strings.Split(inputText, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
 			continue
 		}
-		fmt.Fprintf(output, "\x0C\x0A%s,0", inputFn)
-
-		inputBytes, err := os.ReadFile(inputFn)
-		if err != nil {
-			if !quiet {
-				fmt.Fprintf(stderr, "Skipping %s: %v\n", inputFn, err)
+		if !strings.HasPrefix(line, "//") {
+			break
+		}
+		if constraint.IsGoBuild(line) {
+			if expr, err := constraint.Parse(line); err == nil {
+				return expr.Eval(matchBuildTag)
 			}
+		}
+	}
+	return true
+}
+
+// Generated files are recognized as by the go command, by a comment line that matches generatedRe
+// before the package clause.
+
+var generatedRe = regexp.MustCompile(`^// Code generated .* DO NOT EDIT\.$`)
+
+func isGenerated(inputText string) bool {
+	for _, line := range strings.Split(inputText, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
 			continue
 		}
-		inputText := string(inputBytes)
+		if !strings.HasPrefix(line, "//") {
+			break
+		}
+		if generatedRe.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// With --incremental, previous holds the sections of the existing tags file, by file name as emitted,
+// and the file's modification time.  A section is reused for an input file that has not been
+// modified since then.
+
+type previousTags struct {
+	sections map[string]string
+	mtime    time.Time
+}
+
+var previous *previousTags
+
+func (p *previousTags) lookup(inputFn string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	text, found := p.sections[outputName(tagsDir, inputFn)]
+	if !found {
+		return "", false
+	}
+	info, err := os.Stat(inputFn)
+	if err != nil || info.ModTime().After(p.mtime) {
+		return "", false
+	}
+	return text, true
+}
+
+// readSections splits a tags file into its sections, by file name.  Each section's text runs from its
+// FF through the LF that ends it (and the NUL that follows, with --null-output).
+
+func readSections(text string) map[string]string {
+	sections := make(map[string]string)
+	for {
+		start := strings.Index(text, "\x0C\x0A")
+		if start == -1 {
+			return sections
+		}
+		text = text[start:]
+		end := strings.Index(text[1:], "\x0C\x0A") + 1
+		if end == 0 {
+			end = len(text)
+		}
+		header, _, _ := strings.Cut(text[2:end], "\x0A")
+		if comma := strings.LastIndexByte(header, ','); comma != -1 {
+			if _, found := sections[header[:comma]]; !found {
+				sections[header[:comma]] = text[:end]
+			}
+		}
+		text = text[end:]
+	}
+}
+
+// tagFiles yields the input files in order with the results of tagFile, having printed what tagging
+// each file printed.  With --jobs other than 1 the files are tagged by a pool of workers, each of
+// which reads and parses one file at a time, and the warnings of the input iteration are
+// serialized.  The collector waits for the result of each file in turn, and at most a few files
+// per worker are tagged ahead of the one it waits for.
+
+func tagFiles(inputs iter.Seq[string]) iter.Seq2[string, *fileTags] {
+	workers := jobs
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers == 1 {
+		return func(yield func(string, *fileTags) bool) {
+			for inputFn := range inputs {
+				ft := tagFile(inputFn)
+				ft.flush()
+				if !yield(inputFn, ft) {
+					return
+				}
+			}
+		}
+	}
+	type job struct {
+		inputFn string
+		result  chan *fileTags
+	}
+	return func(yield func(string, *fileTags) bool) {
+		saved := stderr
+		stderr = &lockedWriter{w: saved}
+		work := make(chan job)
+		order := make(chan job, 2*workers)
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		defer func() {
+			close(done)
+			wg.Wait()
+			stderr = saved
+		}()
+		for range workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := range work {
+					j.result <- tagFile(j.inputFn)
+				}
+			}()
+		}
+		go func() {
+			defer close(order)
+			defer close(work)
+			for inputFn := range inputs {
+				j := job{inputFn, make(chan *fileTags, 1)}
+				select {
+				case order <- j:
+				case <-done:
+					return
+				}
+				select {
+				case work <- j:
+				case <-done:
+					return
+				}
+			}
+		}()
+		for j := range order {
+			ft := <-j.result
+			ft.flush()
+			if !yield(j.inputFn, ft) {
+				return
+			}
+		}
+	}
+}
+
+// A lockedWriter serializes the writes of concurrent writers.
+
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// outputName returns the name of the input file inputFn as it is to be emitted in an output file in
+// the directory dir: relative to dir if inputFn is relative and dir is not "", otherwise verbatim.
+
+func outputName(dir, inputFn string) string {
+	if dir == "" || filepath.IsAbs(inputFn) {
+		return inputFn
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return inputFn
+	}
+	absFn, err := filepath.Abs(inputFn)
+	if err != nil {
+		return inputFn
+	}
+	if rel, err := filepath.Rel(absDir, absFn); err == nil {
+		return rel
+	}
+	return inputFn
+}
+
+// With --filter-plugin, the plugin command is run once with the candidate tags on its stdin, one per
+// line, as "name<TAB>file<TAB>line<TAB>kind".  It must echo to its stdout, unchanged, the lines of
+// the tags that are to be kept.  The order of the lines it echoes does not matter.
+
+func filterTags(sections []section) error {
+	candidate := func(inputFn string, t tag) string {
+		return fmt.Sprintf("%s\t%s\t%d\t%s", t.Name, inputFn, t.Line, t.Kind)
+	}
+	cmd := exec.Command("/bin/sh", "-c", filterPlugin)
+	pluginStdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	var subStdout, subStderr strings.Builder
+	cmd.Stdout = &subStdout
+	cmd.Stderr = &subStderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		w := bufio.NewWriter(pluginStdin)
+		for _, s := range sections {
+			for _, t := range s.tags {
+				fmt.Fprintln(w, candidate(s.inputFn, t))
+			}
+		}
+		w.Flush()
+		pluginStdin.Close()
+	}()
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(subStderr.String()))
+	}
+	keep := make(map[string]int)
+	for _, l := range strings.Split(subStdout.String(), "\n") {
+		keep[l]++
+	}
+	for i := range sections {
+		sections[i].tags = slices.DeleteFunc(sections[i].tags, func(t tag) bool {
+			c := candidate(sections[i].inputFn, t)
+			if keep[c] > 0 {
+				keep[c]--
+				return false
+			}
+			return true
+		})
+	}
+	return nil
+}
+
+// ctagsKinds maps tag kinds to the single-letter kinds of the ctags format.
+
+var ctagsKinds = map[string]string{
+	tags.KindPackage:     "p",
+	tags.KindType:        "t",
+	tags.KindFunc:        "f",
+	tags.KindVar:         "v",
+	tags.KindConst:       "c",
+	tags.KindMember:      "m",
+	tags.KindMethodField: "M",
+	tags.KindImport:      "i",
+	tags.KindLinkname:    "l",
+}
+
+// writeCtags writes the tags of all the sections as one ctags file, sorted by name as ctags would
+// (and then by file and line).  The address is a search for the tag's pattern at the start of a
+// line, with the search's delimiter and escape character escaped.  A method has its receiver type
+// as the extension field "struct", and a constant its type, if any, as "enum".  Lines end with CRLF
+// with --output-line-endings=crlf.
+
+func writeCtags(output io.Writer, sections []section) {
+	type ctag struct {
+		inputFn string
+		t       tag
+	}
+	var all []ctag
+	for _, s := range sections {
+		for _, t := range s.tags {
+			all = append(all, ctag{s.inputFn, t})
+		}
+	}
+	slices.SortFunc(all, func(a, b ctag) int {
+		return cmp.Or(
+			strings.Compare(a.t.Name, b.t.Name),
+			strings.Compare(a.inputFn, b.inputFn),
+			cmp.Compare(a.t.Line, b.t.Line),
+		)
+	})
+	escaper := strings.NewReplacer(`\`, `\\`, `/`, `\/`)
+	w := bufio.NewWriter(output)
+	for _, c := range all {
+		fmt.Fprintf(w, "%s\t%s\t/^%s/;\"\tkind:%s",
+			c.t.Name, c.inputFn, escaper.Replace(c.t.Pattern), ctagsKinds[c.t.Kind])
+		if c.t.Receiver != "" {
+			fmt.Fprintf(w, "\tstruct:%s", c.t.Receiver)
+		}
+		if c.t.Scope != "" {
+			fmt.Fprintf(w, "\tenum:%s", c.t.Scope)
+		}
+		if c.t.EndOffset >= 0 {
+			fmt.Fprintf(w, "\tend:%d", c.t.EndOffset)
+		}
+		fmt.Fprint(w, ctagsEOL())
+	}
+	w.Flush()
+}
+
+// ctagsEOL returns the line ending of the ctags format, which can be CRLF.
+
+func ctagsEOL() string {
+	if lineEndings == "crlf" {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// A jsonWriter streams tags as JSON objects, either as the elements of one array or, with
+// --json-lines, one object per line.
+
+type jsonWriter struct {
+	w       io.Writer
+	started bool
+}
+
+type jsonTag struct {
+	Name    string `json:"name"`
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Offset  int    `json:"offset"`
+	End     int    `json:"end"`
+	Kind    string `json:"kind"`
+	Pattern string `json:"pattern"`
+}
 
-		handler(inputFn, inputText, output)
+func (j *jsonWriter) write(s section) {
+	for _, t := range s.tags {
+		bytes, _ := json.Marshal(
+			jsonTag{t.Name, s.inputFn, t.Line, t.Offset, t.EndOffset, t.Kind, t.Pattern})
+		switch {
+		case jsonLines:
+		case !j.started:
+			fmt.Fprint(j.w, "[")
+		default:
+			fmt.Fprint(j.w, ",\n")
+		}
+		j.started = true
+		j.w.Write(bytes)
+		if jsonLines {
+			fmt.Fprint(j.w, "\n")
+		}
+	}
+}
 
-		fmt.Fprintf(output, "\x0A")
+func (j *jsonWriter) close() {
+	if !jsonLines {
+		if !j.started {
+			fmt.Fprint(j.w, "[")
+		}
+		fmt.Fprint(j.w, "]\n")
 	}
-	if len(unhandledFiles) > 0 && systemEtagsCommand != "" {
-		return systemEtags(unhandledFiles, output)
+}
+
+// writeSection writes the tagsection for a file.  Tags whose records are identical to an earlier
+// record in the section are left out, so it returns the number of records written, which is less
+// than the number of tags if some are identical.
+
+func writeSection(output io.Writer, inputFn string, tags []tag) int {
+	fmt.Fprintf(output, "\x0C\x0A%s,0", inputFn)
+	seen := make(map[string]bool)
+	for _, t := range tags {
+		var record string
+		if t.Offset >= 0 {
+			record = fmt.Sprintf("\x0A%s\x7F%s\x01%d,%d", t.Pattern, t.Name, t.Line, t.Offset)
+		} else {
+			record = fmt.Sprintf("\x0A%s\x7F%s\x01%d,", t.Pattern, t.Name, t.Line)
+		}
+		if !seen[record] {
+			seen[record] = true
+			fmt.Fprint(output, record)
+		}
 	}
-	return 0
+	fmt.Fprintf(output, "\x0A")
+	return len(seen)
 }
 
-var fset = token.NewFileSet()
+// parseGo parses the text of a Go file, for --timings accounting for the time spent doing so.
+// Comments are only needed for --linknames.
+
+func parseGo(fset *token.FileSet, inputFn, text string) (*ast.File, error) {
+	defer timings.add(&timings.parse, time.Now())
+	mode := parser.SkipObjectResolution
+	if linknames {
+		mode |= parser.ParseComments
+	}
+	return parser.ParseFile(fset, inputFn, text, mode)
+}
 
-func handleGo(inputFn, inputText string, output io.Writer) {
-	f, err := parser.ParseFile(fset, inputFn, inputText, parser.SkipObjectResolution)
+func handleGo(inputFn, inputText string, ft *fileTags) {
+	f, err := parseGo(ft.fset, inputFn, inputText)
 	if err == nil {
-		goTags(inputFn, inputText, f, output)
+		if dumpAst {
+			fmt.Fprintf(&ft.stderr, "AST for %s:\n", inputFn)
+			ast.Fprint(&ft.stderr, ft.fset, f, ast.NotNilFilter)
+		}
+		goTags(inputFn, inputText, f, ft)
+		return
+	}
+	ft.unparsed = true
+	if onParseError == "skip" {
+		if !quiet {
+			fmt.Fprintf(&ft.stderr, "Omitting section for %s: %v\n", inputFn, err)
+		}
+		ft.suppressed = true
+	} else if onParseError == "fail" {
+		fmt.Fprintf(&ft.stderr, "Could not parse %s: %v\n", inputFn, err)
+		ft.failed = true
+	} else if onParseError == "fallback" && f.Name.Name != "" {
+		// The parser recovers from most errors after the package clause, and the declarations it
+		// did parse are tagged as usual.
+		if !quiet {
+			fmt.Fprintf(&ft.stderr, "Tagging the parsed parts of %s: %v\n", inputFn, err)
+		}
+		goTags(inputFn, inputText, f, ft)
 	} else {
 		if !quiet {
-			fmt.Fprintf(stderr, "Reverting to etags parsing for %s: %v\n", inputFn, err)
+			fmt.Fprintf(&ft.stderr, "Reverting to etags parsing for %s: %v\n", inputFn, err)
+		}
+		builtinGoTags(inputFn, inputText, ft)
+	}
+}
+
+// Each fenced Go block in a Markdown file is parsed separately, as a blank text with the same length
+// and number of newlines as the Markdown text preceding the block, followed by the block's code.
+// Thus the line numbers and byte offsets computed for the block are those of the Markdown file.  If the
+// block has no package clause then a synthetic one is placed in the blanked prefix and is not
+// tagged.  Blocks that still do not parse are skipped, there is no fallback.
+
+var (
+	mdFenceStartRe = regexp.MustCompile("^(```|~~~)\\s*go(?:lang)?\\s*$")
+	mdFenceEndRe   = regexp.MustCompile("^(```|~~~)\\s*$")
+)
+
+func handleMarkdown(inputFn, inputText string, ft *fileTags) {
+	if verbose {
+		fmt.Fprintf(&ft.stdout, "Markdown gotags: %s\n", inputFn)
+	}
+	ft.origin = "gotags"
+	lines := strings.SplitAfter(inputText, "\n")
+	ix := 0
+	for i := 0; i < len(lines); i++ {
+		m := mdFenceStartRe.FindStringSubmatch(strings.TrimRight(lines[i], "\r\n"))
+		ix += len(lines[i])
+		if m == nil {
+			continue
+		}
+		start := ix
+		for i++; i < len(lines); i++ {
+			n := mdFenceEndRe.FindStringSubmatch(strings.TrimRight(lines[i], "\r\n"))
+			if n != nil && n[1] == m[1] {
+				break
+			}
+			ix += len(lines[i])
+		}
+		markdownBlockTags(inputFn, inputText[:start], inputText[start:ix], ft)
+		if i < len(lines) {
+			ix += len(lines[i])
+		}
+	}
+}
+
+func markdownBlockTags(inputFn, prefix, block string, ft *fileTags) {
+	newlines := strings.Count(prefix, "\n")
+	// Newlines last, so that the start of the block's first line is found correctly.
+	blanked := strings.Repeat(" ", len(prefix)-newlines) + strings.Repeat("\n", newlines)
+	text := blanked + block
+	if f, err := parseGo(ft.fset, inputFn, text); err == nil {
+		goTags(inputFn, text, f, ft)
+		return
+	}
+	const clause = "package _;"
+	if len(prefix)-newlines >= len(clause) {
+		text = clause + blanked[len(clause):] + block
+		if f, err := parseGo(ft.fset, inputFn, text); err == nil {
+			ft.add(tagOptions().DeclTags(ft.fset, outputName(tagsDir, inputFn), text, f.Decls))
+			return
 		}
-		builtinGoTags(inputFn, inputText, output)
+	}
+	if !quiet {
+		fmt.Fprintf(&ft.stderr, "Skipping unparseable Go block at line %d of %s\n",
+			newlines+1, inputFn)
 	}
 }
 
-func handlePython(inputFn, inputText string, output io.Writer) {
-	builtinPyTags(inputFn, inputText, output)
+func handlePython(inputFn, inputText string, ft *fileTags) {
+	builtinPyTags(inputFn, inputText, ft)
 }
 
 // Format for our output.
@@ -308,76 +2682,105 @@ func handlePython(inputFn, inputText string, output io.Writer) {
 // Per the standard semantics, as we do not use implicit tags the pattern always ends with the
 // tagname.
 
-func goTags(inputFn, inputText string, f *ast.File, output io.Writer) {
+func goTags(inputFn, inputText string, f *ast.File, ft *fileTags) {
 	if verbose {
-		fmt.Fprintf(stdout, "Gotags: %s\n", inputFn)
+		fmt.Fprintf(&ft.stdout, "Gotags: %s\n", inputFn)
 	}
-	makeTag(inputText, f.Name, output)
-	for _, d := range f.Decls {
-		if fd, ok := d.(*ast.FuncDecl); ok {
-			makeTag(inputText, fd.Name, output)
-			continue
-		}
-		if item, ok := d.(*ast.GenDecl); ok {
-			switch item.Tok {
-			case token.TYPE:
-				for _, spec := range item.Specs {
-					ts := spec.(*ast.TypeSpec)
-					makeTag(inputText, ts.Name, output)
-					if it, ok := ts.Type.(*ast.InterfaceType); ok {
-						for _, field := range it.Methods.List {
-							if _, ok := field.Type.(*ast.FuncType); ok {
-								makeTag(inputText, field.Names[0], output)
-							}
-						}
-					} else if it, ok := ts.Type.(*ast.StructType); members && ok {
-						structTypeTags(inputText, it, output)
-					}
-				}
-			case token.VAR, token.CONST:
-				for _, spec := range item.Specs {
-					vs := spec.(*ast.ValueSpec)
-					for _, name := range vs.Names {
-						makeTag(inputText, name, output)
-					}
-					if item.Tok == token.VAR {
-						if it, ok := vs.Type.(*ast.StructType); members && ok {
-							structTypeTags(inputText, it, output)
-						}
-					}
-				}
-			}
+	// The synthetic names of anonymous functions have the file name of the section they are in.
+	ft.origin = "gotags"
+	ft.add(tagOptions().FileTags(ft.fset, outputName(tagsDir, inputFn), inputText, f))
+}
+
+// tagOptions returns the options for the tags package that correspond to the command line options.
+
+func tagOptions() *tags.Options {
+	return &tags.Options{
+		Kinds:            tagKinds,
+		ExportedOnly:     exportedOnly,
+		QualifiedMembers: qualifiedMembers,
+		InlineMethods:    inlineMethods,
+		AnonFuncs:        anonFuncs,
+		AliasTargets:     aliasTargets,
+		Imports:          importNames,
+		Linknames:        linknames,
+		EnumScope:        enumScope,
+		SignatureRefs:    funcSigRefs,
+		ReceiverRefs:     methodTypeRefs,
+
+		NoStructMembers:    !structMembers,
+		NoInterfaceMembers: !interfaceMembers,
+	}
+}
+
+func kindSet(kinds string) map[string]bool {
+	set := make(map[string]bool)
+	for _, k := range strings.Split(kinds, ",") {
+		if k != "" {
+			set[k] = true
 		}
 	}
+	return set
+}
+
+// A struct type is often declared once per platform in files with different build constraints, and
+// the declarations should agree on the fields.  For --coalesce-fields, structFields maps the
+// directory and name of a struct type to the first file it was seen in and the names of its fields
+// there.  Types of the same name in other directories belong to other packages and are unrelated.
+// The struct types of a file are checked when its section is emitted, so that the files are
+// checked in input order even when they are tagged concurrently.
+
+type structKey struct {
+	dir  string
+	name string
 }
 
-func structTypeTags(inputText string, it *ast.StructType, output io.Writer) {
+type structInfo struct {
+	file   string
+	fields []string
+}
+
+var structFields map[structKey]structInfo
+
+func checkStructFields(inputFn, typeName string, it *ast.StructType) {
+	fields := make([]string, 0)
 	for _, field := range it.Fields.List {
 		for _, name := range field.Names {
-			makeTag(inputText, name, output)
-		}
-		if it, ok := field.Type.(*ast.StructType); ok {
-			structTypeTags(inputText, it, output)
+			fields = append(fields, name.Name)
 		}
 	}
-}
-
-func makeTag(inputText string, name *ast.Ident, output io.Writer) {
-	pos := name.NamePos
-	tf := fset.File(pos)
-	offs := tf.Offset(pos)
-	line := tf.Line(pos)
-	end := offs + len(name.Name)
-	for offs > 0 && inputText[offs-1] != '\n' {
-		offs--
+	key := structKey{filepath.Dir(inputFn), typeName}
+	first, found := structFields[key]
+	if !found {
+		structFields[key] = structInfo{inputFn, fields}
+		return
+	}
+	if first.file == inputFn || quiet {
+		return
+	}
+	missing := slices.DeleteFunc(slices.Clone(first.fields), func(f string) bool {
+		return slices.Contains(fields, f)
+	})
+	extra := slices.DeleteFunc(fields, func(f string) bool {
+		return slices.Contains(first.fields, f)
+	})
+	if len(missing) > 0 {
+		fmt.Fprintf(stderr, "Type %s in %s lacks fields present in %s: %s\n",
+			typeName, inputFn, first.file, strings.Join(missing, ", "))
+	}
+	if len(extra) > 0 {
+		fmt.Fprintf(stderr, "Type %s in %s has fields not present in %s: %s\n",
+			typeName, inputFn, first.file, strings.Join(extra, ", "))
 	}
-	fmt.Fprintf(output, "\x0A%s\x7F%s\x01%d,%d", inputText[offs:end], name.Name, line, offs)
 }
 
-// IdentCharSet is also used by the testing code.  The intent here is to match Go's syntax though
-// without distinguishing between the initial and subsequent characters.
+// IdentPattern is also used by the testing code.  It matches Go's identifier syntax, which Python's
+// agrees with: a letter or underscore followed by letters, digits and underscores.
 
-const identCharSet = `(?:\pL|\pN|_)`
+const (
+	identStartSet = `(?:\pL|_)`
+	identCharSet  = `(?:\pL|\pN|_)`
+	identPattern  = identStartSet + identCharSet + `*`
+)
 
 // GoTagsRe is not entirely etags-equivalent.  It requires the keyword to start in column 0, which is
 // more limiting, but acceptable because that follows standard Go formatting for globals.  On the
@@ -386,69 +2789,282 @@ const identCharSet = `(?:\pL|\pN|_)`
 //
 // Like etags, however, it won't find var/const/type definitions inside lists or subsequent
 // var/const in a single definition, and it will be confused by code inside multi-line strings.
+//
+// The receiver of a method is in parentheses that may contain one level of parentheses, as in
+// func (p (Pair[K, V])) First, and brackets, as in func (m *Map[K, V]) Get, and must be on the same
+// line as the method name, which is always the identifier that follows it.
+
+const receiverPattern = `\((?:[^()]|\([^()]*\))+\)`
 
 var goTagsRe = regexp.MustCompile(
-	`^(?:((?:package|func(?:\s*\([^)]+\))?|type|var|const)\s+(` + identCharSet + `+)))`)
+	`^(?:((package|func(?:\s*` + receiverPattern + `)?|type|var|const)\s+(` + identPattern + `)))`)
+
+// GoTagsPackedRe finds the subsequent declarations on a line whose first declaration was matched by
+// goTagsRe.  It will be fooled by a semicolon followed by a keyword inside a string or block comment.
+
+var goTagsPackedRe = regexp.MustCompile(
+	`;\s*(func(?:\s*` + receiverPattern + `)?|type|var|const)\s+(` + identPattern + `)`)
+
+// The kind of a declaration found by the regular expressions, from its keyword and receiver.
 
-// Note we have no file offsets.  We could fix that.
+func builtinGoKind(keyword string) string {
+	if strings.HasPrefix(keyword, "func") {
+		return tags.KindFunc
+	}
+	return keyword
+}
 
-func builtinGoTags(inputFn, inputText string, output io.Writer) {
+// The offset of a tag is that of the start of the line, as for the tags computed from the AST.
+
+func builtinGoTags(inputFn, inputText string, ft *fileTags) {
 	if verbose {
-		fmt.Fprintf(stdout, "Builtin gotags: %s\n", inputFn)
+		fmt.Fprintf(&ft.stdout, "Builtin gotags: %s\n", inputFn)
 	}
+	ft.origin = "builtin"
 	lineno := 0
+	ix := 0
+	if strings.HasPrefix(inputText, tags.ByteOrderMark) {
+		ix = len(tags.ByteOrderMark)
+		inputText = inputText[ix:]
+	}
 	for _, l := range strings.Split(inputText, "\n") {
 		if m := goTagsRe.FindStringSubmatch(l); m != nil {
-			fmt.Fprintf(output, "\x0A%s\x7F%s\x01%d,", m[1], m[2], lineno+1)
+			ft.tags = append(ft.tags, tag{
+				Name:      m[3],
+				Kind:      builtinGoKind(m[2]),
+				Line:      lineno + 1,
+				Offset:    ix,
+				EndOffset: ix + len(m[1]),
+				Pattern:   m[1],
+			})
+			// Further declarations packed onto the line after the first, eg "type A int; type B int",
+			// but not in a trailing comment.
+			rest, _, _ := strings.Cut(l[len(m[0]):], "//")
+			for _, n := range goTagsPackedRe.FindAllStringSubmatchIndex(rest, -1) {
+				keyword := rest[n[2]:n[3]]
+				end := len(m[0]) + n[5]
+				ft.tags = append(ft.tags, tag{
+					Name:      l[len(m[0])+n[4] : end],
+					Kind:      builtinGoKind(keyword),
+					Line:      lineno + 1,
+					Offset:    ix,
+					EndOffset: ix + end,
+					Pattern:   l[:end],
+				})
+			}
 		}
 		lineno++
+		ix += len(l) + 1
 	}
+	ft.tags = tagOptions().Filter(ft.tags)
 }
 
-var pyTagsRe = regexp.MustCompile(`^\s*(?:def|async\s+def|class)\s+(` + identCharSet + `+)`)
+var pyTagsRe = regexp.MustCompile(`^\s*(def|async\s+def|class)\s+(` + identPattern + `)`)
 
-func builtinPyTags(inputFn, inputText string, output io.Writer) {
+func builtinPyTags(inputFn, inputText string, ft *fileTags) {
 	if verbose {
-		fmt.Fprintf(stdout, "Builtin pytags: %s\n", inputFn)
+		fmt.Fprintf(&ft.stdout, "Builtin pytags: %s\n", inputFn)
 	}
+	ft.origin = "builtin"
 	lineno := 0
+	ix := 0
+	if strings.HasPrefix(inputText, tags.ByteOrderMark) {
+		ix = len(tags.ByteOrderMark)
+		inputText = inputText[ix:]
+	}
 	for _, l := range strings.Split(inputText, "\n") {
 		if m := pyTagsRe.FindStringSubmatch(l); m != nil {
-			fmt.Fprintf(output, "\x0A%s\x7F%s\x01%d,", m[0], m[1], lineno+1)
+			kind := tags.KindFunc
+			if m[1] == "class" {
+				kind = tags.KindType
+			}
+			ft.tags = append(ft.tags, tag{
+				Name:      m[2],
+				Kind:      kind,
+				Line:      lineno + 1,
+				Offset:    ix,
+				EndOffset: ix + len(m[0]),
+				Pattern:   m[0],
+			})
 		}
 		lineno++
+		ix += len(l) + 1
+	}
+	// Python names are not judged by --exported-only, only by --kinds.
+	ft.tags = (&tags.Options{Kinds: tagKinds}).Filter(ft.tags)
+}
+
+// etagsFilter copies the output of the native etags to w as it arrives, logging its sections and
+// with --null-output terminating them with NUL.  FF is not valid in a file name or pattern so every
+// FF starts a section.  The name of a section is logged once its header line "name,size" is
+// complete, with the offset of its FF.  The records are counted as the lines of the output other
+// than the two lines that start each section.
+
+type etagsFilter struct {
+	w          io.Writer
+	sections   *sectionLog
+	started    bool
+	records    int
+	collecting bool
+	header     []byte
+	start      int64
+}
+
+func (f *etagsFilter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if p[0] != '\x0C' {
+			seg := p
+			if ff := bytes.IndexByte(p, '\x0C'); ff != -1 {
+				seg = p[:ff]
+			}
+			f.collect(seg)
+			f.records += bytes.Count(seg, []byte{'\n'})
+			if _, err := f.w.Write(seg); err != nil {
+				return 0, err
+			}
+			p = p[len(seg):]
+			continue
+		}
+		if f.started && nullOutput {
+			if _, err := f.w.Write([]byte{0}); err != nil {
+				return 0, err
+			}
+		}
+		f.started = true
+		f.records -= 2
+		if f.sections != nil {
+			f.collecting = true
+			f.header = f.header[:0]
+			f.start = f.sections.out.n
+		}
+		if _, err := f.w.Write(p[:1]); err != nil {
+			return 0, err
+		}
+		p = p[1:]
+	}
+	return n, nil
+}
+
+// The header is LF name "," size LF, and the bytes of p have not been written yet, so the offset
+// of the section is logged relative to the current output position.
+
+func (f *etagsFilter) collect(p []byte) {
+	if !f.collecting {
+		return
+	}
+	for _, b := range p {
+		if b == '\n' && len(f.header) > 0 {
+			name, _, _ := strings.Cut(string(f.header[1:]), ",")
+			f.sections.log("native", name, f.start-f.sections.out.n)
+			f.collecting = false
+			return
+		}
+		f.header = append(f.header, b)
+	}
+}
+
+func (f *etagsFilter) close() {
+	if f.started && nullOutput {
+		f.w.Write([]byte{0})
+	}
+}
+
+// sortTags sorts the tags of a section for --sort, stably, by name without regard to case or by
+// line number.
+
+func sortTags(ts []tag) {
+	switch sortOrder {
+	case "name":
+		slices.SortStableFunc(ts, func(a, b tag) int {
+			return cmp.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+		})
+	case "line":
+		slices.SortStableFunc(ts, func(a, b tag) int { return cmp.Compare(a.Line, b.Line) })
 	}
 }
 
-func systemEtags(names []string, output io.Writer) int {
+// The native etags is run once per chunk of at most etagsChunkSize files, so that neither its input
+// nor its output for a large tree is held in memory all at once.  The output of each run is written
+// as soon as the run completes.  The exit code is that of the first run that fails.  etagsChunkSize
+// is a variable only so that tests can lower it.
+
+var etagsChunkSize = 512
+
+func systemEtags(names []string, output io.Writer, sections *sectionLog) int {
 	if verbose {
 		for _, inputFn := range names {
 			fmt.Fprintf(stdout, "System etags: %s\n", inputFn)
 		}
 	}
+	exitCode := 0
+	for chunk := range slices.Chunk(names, etagsChunkSize) {
+		if isInterrupted() {
+			return exitInterrupted
+		}
+		r, launched := systemEtagsChunk(chunk, output, sections)
+		if exitCode == 0 {
+			exitCode = r
+		}
+		if !launched {
+			break
+		}
+	}
+	return exitCode
+}
+
+// systemEtagsChunk runs the native etags on names and returns its exit code, and whether it could
+// be run at all.
+
+func systemEtagsChunk(names []string, output io.Writer, sections *sectionLog) (int, bool) {
 	args := []string{"-o", "-", "-"}
-	if !members {
+	if !tagKinds[tags.KindMember] || !structMembers {
 		args = append(args, "--no-members")
 	}
 	cmd := exec.Command(systemEtagsCommand, args...)
+	// With relative names etags is run in the directory of the tags file, as it emits the names it
+	// is given.
+	if tagsDir != "" {
+		cmd.Dir = tagsDir
+		names = slices.Clone(names)
+		for i, inputFn := range names {
+			names[i] = outputName(tagsDir, inputFn)
+		}
+	}
 	cmd.Stdin = strings.NewReader(strings.Join(names, "\n"))
-	var subStdout, subStderr strings.Builder
-	cmd.Stdout = &subStdout
+	filter := &etagsFilter{w: output, sections: sections}
+	var subStderr strings.Builder
+	cmd.Stdout = filter
 	cmd.Stderr = &subStderr
 	err := cmd.Run()
+	filter.close()
+	stats.tags += filter.records
 	// The issue here is that errText is stderr output from the program itself, but if the program
 	// failed to launch there is error text in err, handled later.
 	errText := subStderr.String()
 	if errText != "" {
 		fmt.Fprint(stderr, errText)
 	}
-	fmt.Fprint(output, subStdout.String())
 	if err != nil {
+		// If etags can't be found or started then none of its files are tagged, but the sections
+		// of the other files are fine and are kept.
+		var execErr *exec.Error
+		var pathErr *fs.PathError
+		if errors.As(err, &execErr) || errors.As(err, &pathErr) {
+			if !quiet {
+				fmt.Fprintf(stderr, "Not tagging the files for the native etags, which could not "+
+					"be run: %v\n", err)
+			}
+			return 0, false
+		}
 		fmt.Fprint(stderr, err)
-		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() != 0 {
-			return exitErr.ExitCode()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if exitErr.ExitCode() != 0 {
+				return exitErr.ExitCode(), true
+			}
+			return 1, true
 		}
-		return 1
+		return 1, false
 	}
-	return 0
+	return 0, true
 }
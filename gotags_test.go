@@ -4,18 +4,29 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
+	"go/build"
+	"io"
 	"maps"
+	"math/rand/v2"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"gotags/tags"
 )
 
 var (
-	idAtEnd        = regexp.MustCompile(`(` + identCharSet + `+)$`)
+	idAtEnd        = regexp.MustCompile(`(` + identPattern + `)$`)
 	commaAtEnd     = regexp.MustCompile(`(,\s*)$`)
 	notInNameAtEnd = regexp.MustCompile(`([\t\f\r (),;=]*)$`)
 )
@@ -36,7 +47,15 @@ var (
 // by an issue with the test harness, it weakens testing, we should fix this - the tags program
 // handles interleaved file types and we should test that.)
 
-var testFiles = []string{"testdata/t1.go", "testdata/t2.go", "testdata/t4.py", "testdata/t3.c"}
+var testFiles = []string{
+	"testdata/t1.go",
+	"testdata/t2.go",
+	"testdata/crlf.go",
+	"testdata/crlf2.go",
+	"testdata/generics.go",
+	"testdata/t4.py",
+	"testdata/t3.c",
+}
 
 const (
 	mGotags = iota
@@ -47,7 +66,8 @@ const (
 func TestTagging(t *testing.T) {
 	var out strings.Builder
 	stdout = &out
-	if r := runMain(append([]string{"-o", "-", "-q"}, testFiles...)); r != 0 {
+	args := append([]string{"-o", "-", "-q", "--on-parse-error=builtin"}, testFiles...)
+	if r := runMain(args); r != 0 {
 		t.Fatalf("Exit %d", r)
 	}
 	outLines := strings.Split(out.String(), "\n")
@@ -116,10 +136,8 @@ func TestTagging(t *testing.T) {
 						var expect string
 						lineno := i + 1
 						switch mode {
-						case mGotags:
+						case mGotags, mBuiltinEtags:
 							expect = fmt.Sprintf("%s\x7F%s\x01%d,%d", pattern, tagname, lineno, ix)
-						case mBuiltinEtags:
-							expect = fmt.Sprintf("%s\x7F%s\x01%d,", pattern, tagname, lineno)
 						case mNativeEtags:
 							expect = fmt.Sprintf("%s\x7F%d,%d", pattern, lineno, ix)
 						}
@@ -165,7 +183,13 @@ func TestPipedNames(t *testing.T) {
 	if r := runMain([]string{"-", "-o", outfile.Name()}); r != 0 {
 		t.Fatalf("Exit code %d", r)
 	}
-	// Normally, stderr will have some output b/c we're reverting to etags parsing
+	// Normally, stderr will have some output b/c we're reverting to etags parsing.  The output file
+	// has been replaced, so it must be reopened.
+	outfile, err = os.Open(outfile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outfile.Close()
 	scanner := bufio.NewScanner(outfile)
 	filenames := maps.Collect(slices.All(testFiles))
 	for scanner.Scan() {
@@ -182,13 +206,45 @@ func TestPipedNames(t *testing.T) {
 	}
 }
 
+// "-" among explicit names stands for the names read from stdin, in place.
+func TestMixedPipedNames(t *testing.T) {
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	stdin = strings.NewReader("testdata/t4.py\ntestdata/aliases.go\n")
+	args := []string{"-q", "-o", "-", "testdata/t1.go", "-", "testdata/imports.go"}
+	if r := runMain(args); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	var names []string
+	lines := strings.Split(o1.String(), "\n")
+	for i := 1; i < len(lines); i++ {
+		if lines[i-1] == "\x0C" {
+			name, _, _ := strings.Cut(lines[i], ",")
+			names = append(names, name)
+		}
+	}
+	want := []string{"testdata/t1.go", "testdata/t4.py", "testdata/aliases.go", "testdata/imports.go"}
+	if !slices.Equal(names, want) {
+		t.Fatalf("Got %q want %q", names, want)
+	}
+	o2.Reset()
+	if r := runMain([]string{"-o", "-", "-", "testdata/t1.go", "-"}); r != 2 {
+		t.Fatalf("Exit code %d for two stdins", r)
+	}
+	if !strings.Contains(o2.String(), "stdin can be read only once") {
+		t.Fatalf("Got %q", o2.String())
+	}
+}
+
 // Fallback from full parser to naive built-in parser b/c not well-formed Go, or b/c any Python.
 func TestFallback1(t *testing.T) {
 	for _, testFile := range []string{"testdata/t2.go", "testdata/t4.py"} {
 		var o1, o2 strings.Builder
 		stdout = &o1
 		stderr = &o2
-		if r := runMain([]string{testFile, "-v", "-o", "/dev/null"}); r != 0 {
+		args := []string{testFile, "--on-parse-error=builtin", "-v", "-o", "/dev/null"}
+		if r := runMain(args); r != 0 {
 			t.Fatalf("Exit code %d: %s", r, o2.String())
 		}
 		// Normally, stderr will have some output b/c we're reverting to etags parsing
@@ -208,6 +264,361 @@ func TestFallback1(t *testing.T) {
 	}
 }
 
+func TestDeterministic(t *testing.T) {
+	files := []string{"testdata/t1.go", "testdata/t4.py", "testdata/t3.c", "testdata/sort.go",
+		"testdata/readme.md", "testdata/formfeed.py", "testdata/nested.go"}
+	want := strings.Join(tagLines(t, append([]string{"--deterministic"}, files...)...), "\n")
+	if strings.Join(tagLines(t, files...), "\n") == want {
+		t.Fatalf("Input order not changed")
+	}
+	r := rand.New(rand.NewPCG(1, 2))
+	for range 5 {
+		r.Shuffle(len(files), func(i, j int) { files[i], files[j] = files[j], files[i] })
+		got := strings.Join(tagLines(t, append([]string{"--deterministic"}, files...)...), "\n")
+		if got != want {
+			t.Fatalf("Output differs for %q", files)
+		}
+	}
+}
+
+func TestOutputDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "build", "tags")
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	args := []string{"--output-directory", dir, "-o", "out/MYTAGS", "--method-type-refs",
+		"testdata/t1.go", "testdata/t3.c"}
+	if r := runMain(args); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	text, err := os.ReadFile(filepath.Join(dir, "MYTAGS"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "REFS")); err != nil {
+		t.Fatal(err)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(dir, cwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sections := readSections(string(text))
+	for _, fn := range []string{"testdata/t1.go", "testdata/t3.c"} {
+		if _, found := sections[filepath.Join(rel, fn)]; !found {
+			t.Fatalf("No section for %s in %q", fn, slices.Collect(maps.Keys(sections)))
+		}
+	}
+	if r := runMain([]string{"--output-directory", dir, "-o", "-", "testdata/t1.go"}); r != 2 {
+		t.Fatalf("Exit code %d for stdout", r)
+	}
+}
+
+func TestMethodFields(t *testing.T) {
+	kinds := func(lines []string) map[string]string {
+		ks := make(map[string]string)
+		for _, l := range lines {
+			name, _, _ := strings.Cut(l, "\t")
+			if _, rest, ok := strings.Cut(l, "\tkind:"); ok {
+				ks[name], _, _ = strings.Cut(rest, "\t")
+			}
+		}
+		return ks
+	}
+	got := kinds(tagLines(t, "--format=ctags", "--kinds=member", "testdata/methodfields.go"))
+	want := map[string]string{
+		"Name": "m", "Label": "m", "Width": "m", "OnClick": "M", "Filter": "M",
+	}
+	if !maps.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+	lines := tagLines(t, "--format=json", "--json-lines", "testdata/methodfields.go")
+	if !slices.ContainsFunc(lines, func(l string) bool {
+		return strings.Contains(l, `"name":"OnClick"`) && strings.Contains(l, `"kind":"method-field"`)
+	}) {
+		t.Fatalf("Got %q", lines)
+	}
+	if got := tagLines(t, "testdata/methodfields.go"); !slices.Contains(got, "\tOnClick\x7fOnClick\x017,93") {
+		t.Fatalf("Got %q", got)
+	}
+}
+
+// Only aliased imports are tagged, and only with --imports.
+func TestImports(t *testing.T) {
+	want := []string{
+		"imports\ttestdata/imports.go\t/^package imports/;\"\tkind:p\tend:15",
+		"sc\ttestdata/imports.go\t/^import sc/;\"\tkind:i\tend:81",
+		"str\ttestdata/imports.go\t/^\tstr/;\"\tkind:i\tend:37",
+		"",
+	}
+	if got := tagLines(t, "--imports", "--format=ctags", "testdata/imports.go"); !slices.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+	if got := tagLines(t, "--format=ctags", "testdata/imports.go"); !slices.Equal(got, []string{want[0], ""}) {
+		t.Fatalf("Got %q", got)
+	}
+	got := tagLines(t, "--imports", "--kinds=package", "--format=ctags", "testdata/imports.go")
+	if !slices.Equal(got, []string{want[0], ""}) {
+		t.Fatalf("Got %q", got)
+	}
+}
+
+func TestKindFilterFile(t *testing.T) {
+	filter, err := os.CreateTemp("", "kinds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filter.Name())
+	filter.WriteString("# Functions and types only\nkinds=func,type\nexclude=t2\\.go\n")
+	filter.Close()
+	kinds := func(lines []string) []string {
+		var ks []string
+		for _, l := range lines {
+			if _, rest, ok := strings.Cut(l, "\tkind:"); ok {
+				k, _, _ := strings.Cut(rest, "\t")
+				ks = append(ks, k)
+			}
+		}
+		slices.Sort(ks)
+		return slices.Compact(ks)
+	}
+	files := []string{"testdata/t1.go", "testdata/t2.go"}
+	args := append([]string{"--format=ctags", "--kind-filter-file", filter.Name()}, files...)
+	lines := tagLines(t, args...)
+	if got, want := kinds(lines), []string{"f", "t"}; !slices.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+	if slices.ContainsFunc(lines, func(l string) bool { return strings.Contains(l, "t2.go") }) {
+		t.Fatalf("Excluded file tagged: %q", lines)
+	}
+	lines = tagLines(t, append([]string{"--kinds=func,type,var"}, args...)...)
+	if got, want := kinds(lines), []string{"f", "t", "v"}; !slices.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	os.WriteFile(filter.Name(), []byte("kinds=func\nonly=type\n"), 0666)
+	args = append([]string{"--kind-filter-file", filter.Name(), "-o", "-"}, files...)
+	if r := runMain(args); r != 1 {
+		t.Fatalf("Exit code %d", r)
+	}
+	if !strings.Contains(o2.String(), ":2: unknown key \"only\"") {
+		t.Fatalf("Got %q", o2.String())
+	}
+}
+
+// Constants of a named type, also those that repeat the type implicitly, have it as their scope.
+func TestEnumScope(t *testing.T) {
+	want := []string{
+		"Aspirin\ttestdata/stringer.go\t/^\tAspirin/;\"\tkind:c\tenum:Pill\tend:70",
+		"Ibuprofen\ttestdata/stringer.go\t/^\tIbuprofen/;\"\tkind:c\tenum:Pill\tend:81",
+		"Limit\ttestdata/stringer.go\t/^\tLimit/;\"\tkind:c\tend:211",
+		"Placebo\ttestdata/stringer.go\t/^\tPlacebo/;\"\tkind:c\tenum:Pill\tend:49",
+		"Repeat\ttestdata/stringer.go\t/^\tRepeat/;\"\tkind:c\tend:229",
+		"Untyped\ttestdata/stringer.go\t/^const Untyped/;\"\tkind:c\tend:191",
+	}
+	got := tagLines(t, "--enum-scope", "--format=ctags", "--kinds=const", "testdata/stringer.go")
+	if !slices.Equal(got[:len(got)-1], want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+	got = tagLines(t, "--format=ctags", "--kinds=const", "testdata/stringer.go")
+	if countPrefixed(got, "Placebo\t") != 1 || slices.ContainsFunc(got, func(l string) bool {
+		return strings.Contains(l, "enum:")
+	}) {
+		t.Fatalf("Got %q", got)
+	}
+}
+
+func TestLinknames(t *testing.T) {
+	want := []string{
+		"Exported\ttestdata/linkname.go\t/^\\/\\/go:linkname Exported/;\"\tkind:l\tend:168",
+		"nanotime\ttestdata/linkname.go\t/^\\/\\/go:linkname nanotime/;\"\tkind:l\tend:105",
+	}
+	got := tagLines(t, "--linknames", "--format=ctags", "testdata/linkname.go")
+	got = slices.DeleteFunc(got, func(l string) bool { return !strings.Contains(l, "\tkind:l\t") })
+	if !slices.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+	lines := tagLines(t, "--linknames", "testdata/linkname.go")
+	if !slices.Contains(lines, "//go:linkname nanotime\x7Fnanotime\x017,83") {
+		t.Fatalf("Got %q", lines)
+	}
+	if countPrefixed(tagLines(t, "testdata/linkname.go"), "//go:linkname") != 0 {
+		t.Fatal("Linkname tagged without --linknames")
+	}
+}
+
+func TestPreserveOrder(t *testing.T) {
+	files := []string{"testdata/t3.c", "testdata/t1.go", "testdata/readme.md", "testdata/t4.py"}
+	names := func(text string) []string {
+		var ns []string
+		lines := strings.Split(text, "\n")
+		for i := 1; i < len(lines); i++ {
+			if lines[i-1] == "\x0C" {
+				name, _, _ := strings.Cut(lines[i], ",")
+				ns = append(ns, name)
+			}
+		}
+		return ns
+	}
+	batched := strings.Join(tagLines(t, files...), "\n")
+	ordered := strings.Join(tagLines(t, append([]string{"--preserve-order"}, files...)...), "\n")
+	if got := names(ordered); !slices.Equal(got, files) {
+		t.Fatalf("Got %q want %q", got, files)
+	}
+	want := []string{"testdata/t1.go", "testdata/t4.py", "testdata/t3.c", "testdata/readme.md"}
+	if got := names(batched); !slices.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+	if got, want := readSections(ordered), readSections(batched); !maps.Equal(got, want) {
+		t.Fatalf("Got sections %q want %q", got, want)
+	}
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	if r := runMain(append([]string{"--preserve-order", "--format=ctags", "-o", "-"}, files...)); r != 2 {
+		t.Fatalf("Exit code %d for --preserve-order with ctags", r)
+	}
+}
+
+func TestLangMap(t *testing.T) {
+	lines := tagLines(t, "--lang-map=.gohtml=go", "testdata/page.gohtml")
+	for _, want := range []string{"type Page\x7FPage\x013,", "\tTitle\x7FTitle\x014,",
+		"func Render\x7FRender\x017,"} {
+		if countPrefixed(lines, want) != 1 {
+			t.Fatalf("No %q in %q", want, lines)
+		}
+	}
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	if r := runMain([]string{"-v", "-o", "/dev/null", "testdata/page.gohtml"}); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	if !strings.Contains(o1.String(), "System etags: testdata/page.gohtml") {
+		t.Fatalf("Unmapped file not given to etags: %s", o1.String())
+	}
+	for _, arg := range []string{"--lang-map=gohtml=go", "--lang-map=.gohtml=c", "--lang-map=.gohtml"} {
+		if r := runMain([]string{arg, "-o", "-", "testdata/page.gohtml"}); r != 2 {
+			t.Fatalf("Exit code %d for %s", r, arg)
+		}
+	}
+}
+
+// As for etags, -f is the same as -o.
+func TestOutputAlias(t *testing.T) {
+	want := tagLines(t, "testdata/t1.go")
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	if r := runMain([]string{"-f", "-", "testdata/t1.go"}); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	if got := strings.Split(o1.String(), "\n"); !slices.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+	outname := filepath.Join(t.TempDir(), "TAGS")
+	if r := runMain([]string{"-f" + outname, "testdata/t1.go"}); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	if text, err := os.ReadFile(outname); err != nil || string(text) != strings.Join(want, "\n") {
+		t.Fatalf("Got %q: %v", text, err)
+	}
+}
+
+// No fallback with --strict: the unparseable file is reported and gets no section, or with
+// --on-parse-error=fail the run fails, whatever the order of the options.
+func TestStrict(t *testing.T) {
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	if r := runMain([]string{"--strict", "-o", "-", "testdata/t1.go", "testdata/t2.go"}); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	sections := readSections(o1.String())
+	if _, found := sections["testdata/t2.go"]; found || len(sections) != 1 {
+		t.Fatalf("Got sections for %q", slices.Collect(maps.Keys(sections)))
+	}
+	if strings.Contains(o1.String(), "package Pack") {
+		t.Fatalf("Tags for unparseable file: %q", o1.String())
+	}
+	if !strings.Contains(o2.String(), "Omitting section for testdata/t2.go") {
+		t.Fatalf("No error message: %s", o2.String())
+	}
+	for _, args := range [][]string{
+		{"--strict", "--on-parse-error=fail"},
+		{"--on-parse-error=fail", "--strict"},
+	} {
+		o2.Reset()
+		if r := runMain(append(args, "-o", "/dev/null", "testdata/t2.go")); r != 1 {
+			t.Fatalf("Exit code %d for %q", r, args)
+		}
+		if !strings.Contains(o2.String(), "Could not parse testdata/t2.go") {
+			t.Fatalf("No error message: %s", o2.String())
+		}
+	}
+	for _, action := range []string{"fallback", "builtin"} {
+		args := []string{"--strict", "--on-parse-error=" + action, "-o", "-", "testdata/t2.go"}
+		if r := runMain(args); r != 2 {
+			t.Fatalf("Exit code %d for %s", r, action)
+		}
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	files := []string{"testdata/t1.go", "testdata/t4.py", "testdata/t3.c"}
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	if r := runMain(append([]string{"--max-file-size=1000", "--stats", "-o", "-"}, files...)); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	sections := readSections(o1.String())
+	if _, found := sections["testdata/t1.go"]; found || len(sections) != 2 {
+		t.Fatalf("Got sections %q", slices.Collect(maps.Keys(sections)))
+	}
+	for _, want := range []string{"Skipping testdata/t1.go: larger than 1000 bytes\n", "Files skipped: 1\n"} {
+		if !strings.Contains(o2.String(), want) {
+			t.Fatalf("No %q in %q", want, o2.String())
+		}
+	}
+	if got, want := tagLines(t, append([]string{"--max-file-size=0"}, files...)...),
+		tagLines(t, files...); !slices.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+}
+
+// The output is as without --error-on-fallback, but the exit code is not.
+func TestErrorOnFallback(t *testing.T) {
+	files := []string{"testdata/t1.go", "testdata/t2.go", "testdata/t4.py", "testdata/generics.go"}
+	want := tagLines(t, append([]string{"-q"}, files...)...)
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	if r := runMain(append([]string{"--error-on-fallback", "-o", "-"}, files...)); r != exitFallback {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	if got := strings.Split(o1.String(), "\n"); !slices.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+	if !strings.HasSuffix(o2.String(),
+		"Go files that could not be parsed:\n  testdata/t2.go\n  testdata/generics.go\n") {
+		t.Fatalf("No list of files: %s", o2.String())
+	}
+	o2.Reset()
+	args := []string{"-q", "--error-on-fallback", "--strict", "-o", "/dev/null", "testdata/t2.go"}
+	if r := runMain(args); r != exitFallback || o2.Len() != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	if r := runMain([]string{"--error-on-fallback", "-o", "/dev/null", "testdata/t1.go"}); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+}
+
 // Fallback from full parser to external etags b/c not Go or Python.
 func TestFallback2(t *testing.T) {
 	var o1, o2 strings.Builder
@@ -229,3 +640,2109 @@ func TestFallback2(t *testing.T) {
 		t.Fatalf("Did not see verbose output about fallback")
 	}
 }
+
+// With --output-bom the BOM precedes the first tagsection and the sections are otherwise unchanged.
+func TestOutputBom(t *testing.T) {
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	if r := runMain([]string{"--output-bom", "-o", "-", "testdata/t1.go"}); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	bom := "\xEF\xBB\xBF"
+	got := o1.String()
+	if !strings.HasPrefix(got, bom+"\x0C\x0A") {
+		t.Fatalf("Expected BOM before first section, got %q", got[:min(len(got), 10)])
+	}
+	var o3 strings.Builder
+	stdout = &o3
+	if r := runMain([]string{"-o", "-", "testdata/t1.go"}); r != 0 {
+		t.Fatalf("Exit code %d", r)
+	}
+	if got[len(bom):] != o3.String() {
+		t.Fatalf("Sections differ with and without BOM")
+	}
+}
+
+func TestAppend(t *testing.T) {
+	tagsFile, err := os.CreateTemp("", "tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagsFile.Close()
+	defer os.Remove(tagsFile.Name())
+	var o2 strings.Builder
+	stderr = &o2
+	for _, args := range [][]string{
+		{"--output-bom", "-o", tagsFile.Name(), "testdata/t1.go"},
+		{"-a", "--output-bom", "-o", tagsFile.Name(), "testdata/t2.go"},
+	} {
+		if r := runMain(args); r != 0 {
+			t.Fatalf("Exit code %d: %s", r, o2.String())
+		}
+	}
+	got, err := os.ReadFile(tagsFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var o1 strings.Builder
+	stdout = &o1
+	if r := runMain([]string{"--output-bom", "-o", "-", "testdata/t1.go", "testdata/t2.go"}); r != 0 {
+		t.Fatalf("Exit code %d", r)
+	}
+	if string(got) != o1.String() {
+		t.Fatalf("Appended output differs from output for both files")
+	}
+	for _, format := range []string{"json", "ctags"} {
+		args := []string{"-a", "--format", format, "-o", tagsFile.Name(), "testdata/t1.go"}
+		if r := runMain(args); r != 2 {
+			t.Fatalf("Exit code %d for appending %s", r, format)
+		}
+	}
+	if after, _ := os.ReadFile(tagsFile.Name()); string(after) != string(got) {
+		t.Fatalf("Output file changed by rejected append")
+	}
+}
+
+func TestCtagsFormat(t *testing.T) {
+	lines := tagLines(t, "--format", "ctags", "testdata/t1.go", "testdata/t2.go", "testdata/t4.py")
+	if lines[len(lines)-1] != "" {
+		t.Fatalf("Last line not terminated")
+	}
+	lines = lines[:len(lines)-1]
+	if !slices.IsSortedFunc(lines, func(a, b string) int {
+		return strings.Compare(strings.Split(a, "\t")[0], strings.Split(b, "\t")[0])
+	}) {
+		t.Fatalf("Not sorted: %q", lines)
+	}
+	// The address may itself contain tabs.
+	for _, l := range lines {
+		fields := strings.SplitN(l, "\t", 3)
+		if len(fields) != 3 || fields[0] == "" || fields[1] == "" {
+			t.Fatalf("Malformed line %q", l)
+		}
+		address, kind, found := strings.Cut(fields[2], "/;\"\tkind:")
+		kind, _, _ = strings.Cut(kind, "\t")
+		if !found || !strings.HasPrefix(address, "/^") ||
+			!slices.Contains([]string{"p", "t", "f", "v", "c", "m"}, kind) {
+			t.Fatalf("Malformed line %q", l)
+		}
+	}
+	if !slices.Contains(lines, "MyClass\ttestdata/t4.py\t/^class MyClass/;\"\tkind:t\tend:315") {
+		t.Fatalf("Python class not tagged: %q", lines)
+	}
+}
+
+// The end offset is just past the name, and the name ends the pattern that starts at the offset.
+func TestEndOffsets(t *testing.T) {
+	files := []string{"testdata/t1.go", "testdata/t2.go", "testdata/t4.py", "testdata/multibyte.go"}
+	text := make(map[string]string)
+	for _, fn := range files {
+		bs, err := os.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		text[fn] = string(bs)
+	}
+	var tags []struct {
+		Name, File, Pattern string
+		Offset, End         int
+	}
+	lines := tagLines(t, append([]string{"-q", "--format=json"}, files...)...)
+	if err := json.Unmarshal([]byte(strings.Join(lines, "\n")), &tags); err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range tags {
+		if tag.End != tag.Offset+len(tag.Pattern) || tag.End < len(tag.Name) ||
+			text[tag.File][tag.End-len(tag.Name):tag.End] != tag.Name {
+			t.Fatalf("Bad end offset: %+v", tag)
+		}
+	}
+	lines = tagLines(t, append([]string{"-q", "--format=ctags"}, files...)...)
+	for _, l := range lines[:len(lines)-1] {
+		fields := strings.Split(l, "\t")
+		end, err := strconv.Atoi(strings.TrimPrefix(fields[len(fields)-1], "end:"))
+		if err != nil || end < len(fields[0]) || text[fields[1]][end-len(fields[0]):end] != fields[0] {
+			t.Fatalf("Bad end offset: %q", l)
+		}
+	}
+	if len(lines)-1 != len(tags) {
+		t.Fatalf("Got %d ctags lines for %d tags", len(lines)-1, len(tags))
+	}
+}
+
+func TestCtagsReceivers(t *testing.T) {
+	want := []string{
+		"G\ttestdata/receivers.go\t/^type G/;\"\tkind:t\tend:86",
+		"Generic\ttestdata/receivers.go\t/^func (g *G[K, E]) Generic/;\"\tkind:f\tstruct:G\tend:143",
+		"Plain\ttestdata/receivers.go\t/^func Plain/;\"\tkind:f\tend:160",
+		"Pointer\ttestdata/receivers.go\t/^func (v *V) Pointer/;\"\tkind:f\tstruct:V\tend:73",
+		"V\ttestdata/receivers.go\t/^type V/;\"\tkind:t\tend:25",
+		"Value\ttestdata/receivers.go\t/^func (v V) Value/;\"\tkind:f\tstruct:V\tend:47",
+		"receivers\ttestdata/receivers.go\t/^package receivers/;\"\tkind:p\tend:17",
+		"",
+	}
+	if got := tagLines(t, "--format=ctags", "testdata/receivers.go"); !slices.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	files := []string{"testdata/t1.go", "testdata/t2.go", "testdata/t4.py"}
+	etags := 0
+	for _, l := range tagLines(t, files...) {
+		if strings.Contains(l, "\x7F") {
+			etags++
+		}
+	}
+	type jsonTag struct {
+		Name, File, Kind, Pattern string
+		Line, Offset              int
+	}
+	var tags []jsonTag
+	lines := tagLines(t, append([]string{"--format", "json"}, files...)...)
+	if err := json.Unmarshal([]byte(strings.Join(lines, "\n")), &tags); err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != etags {
+		t.Fatalf("Got %d tags want %d", len(tags), etags)
+	}
+	for _, tag := range tags {
+		if !strings.HasSuffix(tag.Pattern, tag.Name) || !slices.Contains(files, tag.File) {
+			t.Fatalf("Bad tag %v", tag)
+		}
+	}
+	lines = tagLines(t, append([]string{"--format", "json", "--json-lines"}, files...)...)
+	for i, l := range lines[:len(lines)-1] {
+		var tag jsonTag
+		if err := json.Unmarshal([]byte(l), &tag); err != nil {
+			t.Fatal(err)
+		}
+		if tag != tags[i] {
+			t.Fatalf("Got %v want %v", tag, tags[i])
+		}
+	}
+	if len(lines)-1 != etags {
+		t.Fatalf("Got %d lines want %d", len(lines)-1, etags)
+	}
+}
+
+// A name defined in several build-tagged files has an entry for each file.
+func TestJSONPerFile(t *testing.T) {
+	var tags []struct {
+		Name, File, Kind string
+		Line             int
+	}
+	lines := tagLines(t, "--format=json", "testdata/version_a.go", "testdata/version_b.go")
+	if err := json.Unmarshal([]byte(strings.Join(lines, "\n")), &tags); err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, tag := range tags {
+		if tag.Name == "Version" && tag.Line == 5 {
+			files = append(files, tag.File)
+		}
+	}
+	if want := []string{"testdata/version_a.go", "testdata/version_b.go"}; !slices.Equal(files, want) {
+		t.Fatalf("Got %q want %q in %v", files, want, tags)
+	}
+}
+
+func TestRelative(t *testing.T) {
+	dir, err := os.MkdirTemp("testdata", "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tagsFn := filepath.Join(dir, "TAGS")
+	var o2 strings.Builder
+	stderr = &o2
+	if r := runMain([]string{"--relative", "-o", tagsFn, "testdata/mod/a.go", "testdata/t4.py"}); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	got, err := os.ReadFile(tagsFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(got), "\n")
+	if countPrefixed(lines, "../mod/a.go,0") != 1 || countPrefixed(lines, "../t4.py,0") != 1 {
+		t.Fatalf("Names not rewritten: %q", lines)
+	}
+	lines = tagLines(t, "--relative", "testdata/mod/a.go")
+	if countPrefixed(lines, "testdata/mod/a.go,0") != 1 {
+		t.Fatalf("Names rewritten for stdout: %q", lines)
+	}
+}
+
+func TestRecursive(t *testing.T) {
+	want := []string{"testdata/tree/a.go,0", "testdata/tree/sub/b.go,0", "testdata/tree/sub/c.py,0"}
+	for _, arg := range []string{"testdata/tree", "testdata/tree/..."} {
+		var got []string
+		for _, l := range tagLines(t, "-R", arg) {
+			if strings.HasPrefix(l, "testdata/") {
+				got = append(got, l)
+			}
+		}
+		if !slices.Equal(got, want) {
+			t.Fatalf("Got %q want %q", got, want)
+		}
+	}
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	if r := runMain([]string{"-o", "-", "testdata/tree"}); r == 0 {
+		t.Fatalf("Directory accepted without -R")
+	}
+	if !strings.Contains(o2.String(), "is a directory") {
+		t.Fatalf("Unexpected error: %s", o2.String())
+	}
+}
+
+func TestExcludeDir(t *testing.T) {
+	files := func(args ...string) []string {
+		var got []string
+		for _, l := range tagLines(t, append(args, "-R", "testdata/ignored")...) {
+			if strings.HasPrefix(l, "testdata/") {
+				name, _, _ := strings.Cut(l, ",")
+				got = append(got, name)
+			}
+		}
+		return got
+	}
+	all := files()
+	got := files("--exclude-dir=gen", "--exclude-dir", "docs")
+	want := slices.DeleteFunc(slices.Clone(all), func(name string) bool {
+		return strings.Contains(name, "/gen/") || strings.Contains(name, "/docs/")
+	})
+	if !slices.Equal(got, want) || len(want) != len(all)-4 {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+	// A directory given as an argument is tagged even if its name is excluded.
+	if got := files("--exclude-dir=ignored"); !slices.Equal(got, all) {
+		t.Fatalf("Got %q want %q", got, all)
+	}
+}
+
+func TestRespectGitignore(t *testing.T) {
+	// The tree has a .gitignore that ignores the top-level gen directory, build directories and
+	// *.pb.go files anywhere, except keep.pb.go, and Go files under docs at any depth, and
+	// sub/.gitignore ignores local.go in sub only.
+	want := []string{
+		"testdata/ignored/a.go,0",
+		"testdata/ignored/docs/top.py,0",
+		"testdata/ignored/keep.pb.go,0",
+		"testdata/ignored/local.go,0",
+		"testdata/ignored/sub/gen/g.go,0",
+	}
+	var got []string
+	for _, l := range tagLines(t, "-R", "--respect-gitignore", "testdata/ignored") {
+		if strings.HasPrefix(l, "testdata/") {
+			got = append(got, l)
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+	if n := countPrefixed(tagLines(t, "-R", "testdata/ignored"), "testdata/"); n != 11 {
+		t.Fatalf("Got %d files without --respect-gitignore", n)
+	}
+}
+
+func TestParallelJobs(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = append(files, "testdata/t4.py", "testdata/t3.c", "testdata/nonexistent.go")
+	files = slices.Concat(files, files, files, files)
+	run := func(args ...string) (string, string) {
+		var o1, o2 strings.Builder
+		stdout = &o1
+		stderr = &o2
+		args = append([]string{"--coalesce-fields", "--func-signature-refs", "--refs-output",
+			"/dev/null", "-o", "-"}, args...)
+		if r := runMain(append(args, files...)); r != 0 {
+			t.Fatalf("Exit code %d: %s", r, o2.String())
+		}
+		return o1.String(), o2.String()
+	}
+	serialOut, serialErr := run()
+	for _, n := range []string{"0", "2", "8"} {
+		out, errs := run("--jobs", n)
+		if out != serialOut {
+			t.Fatalf("Output with %s jobs differs from serial output", n)
+		}
+		// Warnings about files are not ordered, but those about struct fields are.
+		got, want := strings.Split(errs, "\n"), strings.Split(serialErr, "\n")
+		isFile := func(l string) bool { return !strings.HasPrefix(l, "Type ") }
+		if !slices.Equal(slices.Sorted(slices.Values(got)), slices.Sorted(slices.Values(want))) ||
+			!slices.Equal(slices.DeleteFunc(got, isFile), slices.DeleteFunc(want, isFile)) {
+			t.Fatalf("Warnings with %s jobs differ: got %q want %q", n, errs, serialErr)
+		}
+	}
+}
+
+// What tagging a file prints, with -v to stdout and with --dump-ast to stderr, is printed in input
+// order, and not inside the output of other files.
+func TestParallelVerbose(t *testing.T) {
+	text, err := os.ReadFile("testdata/t1.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	var files []string
+	for i := range 40 {
+		fn := filepath.Join(dir, fmt.Sprintf("t%d.go", i))
+		if err := os.WriteFile(fn, text, 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, fn)
+	}
+	run := func(jobs string) (string, string) {
+		var o1, o2 strings.Builder
+		stdout = &o1
+		stderr = &o2
+		args := []string{"-v", "--dump-ast", "--jobs", jobs, "-o", "-"}
+		if r := runMain(append(args, files...)); r != 0 {
+			t.Fatalf("Exit code %d: %s", r, o2.String())
+		}
+		return o1.String(), o2.String()
+	}
+	serialOut, serialErr := run("1")
+	if !strings.Contains(serialOut, "Gotags: "+files[0]+"\n\x0C\n"+files[0]+",0\n") {
+		t.Fatalf("No verbose output before the section: %q", serialOut[:100])
+	}
+	out, errs := run("8")
+	if out != serialOut {
+		t.Fatalf("Output with 8 jobs differs from serial output")
+	}
+	if errs != serialErr {
+		t.Fatalf("AST dumps with 8 jobs differ from serial dumps")
+	}
+}
+
+func TestExportedOnly(t *testing.T) {
+	names := func(lines []string) []string {
+		var ns []string
+		for _, l := range lines {
+			if _, after, found := strings.Cut(l, "\x7F"); found {
+				ns = append(ns, after[:strings.IndexByte(after, '\x01')])
+			}
+		}
+		return ns
+	}
+	all := names(tagLines(t, "testdata/exported.go"))
+	for _, n := range []string{"count", "private", "unexported", "method", "v", "c", "undo", "y", "t"} {
+		if !slices.Contains(all, n) {
+			t.Fatalf("%s not tagged without flag: %q", n, all)
+		}
+	}
+	got := names(tagLines(t, "--exported-only", "testdata/exported.go"))
+	want := []string{"exported", "Public", "Name", "Exported", "Method", "V", "C", "Iface", "Do", "S", "X"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+}
+
+func TestQualifiedMembers(t *testing.T) {
+	want := []string{
+		"\tf1\x7Ft3.f1\x014,36",
+		"\tinner\x7Ft3.inner\x015,47",
+		"\t\tf2\x7Ft3.inner.f2\x016,63",
+		"\tm1\x7FI.m1\x0111,97",
+		"func (p *t3) m1\x7Ft3.m1\x0114,106",
+		"func (l List[T]) Len\x7FList.Len\x0116,128",
+	}
+	plain := tagLines(t, "testdata/qualified.go")
+	lines := tagLines(t, "--qualified-members", "testdata/qualified.go")
+	var got []string
+	for _, l := range lines {
+		if strings.Contains(l, ".") && !strings.HasPrefix(l, "testdata/") {
+			got = append(got, l)
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+	if len(lines) != len(plain)+len(want) {
+		t.Fatalf("Bare tags not kept: %q", lines)
+	}
+}
+
+// Records that differ only in kind are identical in the tagsection.
+func TestDuplicateRecords(t *testing.T) {
+	ts := []tag{
+		{Name: "A", Kind: tags.KindType, Line: 1, Offset: 0, Pattern: "type A"},
+		{Name: "f", Kind: tags.KindMember, Line: 2, Offset: 9, Pattern: "\tf"},
+		{Name: "A", Kind: tags.KindType, Line: 1, Offset: 0, Pattern: "type A"},
+		{Name: "f", Kind: tags.KindFunc, Line: 2, Offset: 9, Pattern: "\tf"},
+		{Name: "f", Kind: tags.KindMember, Line: 2, Offset: -1, Pattern: "\tf"},
+	}
+	var sb strings.Builder
+	writeSection(&sb, "x.go", ts)
+	want := "\x0C\nx.go,0\ntype A\x7FA\x011,0\n\tf\x7Ff\x012,9\n\tf\x7Ff\x012,\n"
+	if sb.String() != want {
+		t.Fatalf("Got %q want %q", sb.String(), want)
+	}
+}
+
+func TestGzipInput(t *testing.T) {
+	want := []string{
+		"\x0C",
+		"testdata/gz.go.gz,0",
+		"package gz\x7Fgz\x011,0",
+		"func Inflated\x7FInflated\x014,34",
+		"var Z\x7FZ\x016,54",
+		"",
+	}
+	got := tagLines(t, "testdata/gz.go.gz")
+	if !slices.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+}
+
+func TestBuildTags(t *testing.T) {
+	if runtime.GOOS == "plan9" {
+		t.Skip("Test assumes a host other than plan9")
+	}
+	files := []string{"testdata/build/feature.go", "testdata/build/plain.go",
+		"testdata/build/sys_linux_amd64.go", "testdata/build/sys_plan9.go"}
+	sections := func(args ...string) []string {
+		var fns []string
+		for _, l := range tagLines(t, append(args, files...)...) {
+			if fn, found := strings.CutSuffix(l, ",0"); found && strings.HasPrefix(l, "testdata/") {
+				fns = append(fns, fn)
+			}
+		}
+		return fns
+	}
+	if got := sections(); !slices.Equal(got, files) {
+		t.Fatalf("Files excluded without --tags: %q", got)
+	}
+	host := runtime.GOOS == "linux" && runtime.GOARCH == "amd64"
+	for _, c := range []struct {
+		tags    string
+		feature bool
+	}{{"feature", true}, {"feature,nofeature", false}, {"", false}} {
+		want := []string{"testdata/build/plain.go"}
+		if c.feature {
+			want = append([]string{"testdata/build/feature.go"}, want...)
+		}
+		if host {
+			want = append(want, "testdata/build/sys_linux_amd64.go")
+		}
+		if got := sections("--tags", c.tags); !slices.Equal(got, want) {
+			t.Fatalf("With --tags %q got %q want %q", c.tags, got, want)
+		}
+	}
+}
+
+// A compound //go:build expression is evaluated as a whole for the target GOOS and GOARCH.
+func TestCompoundBuildConstraint(t *testing.T) {
+	defer func(saved *build.Context) { buildContext = saved }(buildContext)
+	for _, c := range []struct {
+		goos, goarch string
+		tagged       bool
+	}{
+		{"linux", "amd64", true},
+		{"linux", "arm64", false},
+		{"android", "amd64", true},
+		{"darwin", "arm64", true},
+		{"darwin", "amd64", true},
+		{"ios", "arm64", true},
+		{"windows", "amd64", false},
+		{"freebsd", "amd64", false},
+	} {
+		ctx := build.Default
+		ctx.GOOS, ctx.GOARCH = c.goos, c.goarch
+		buildContext = &ctx
+		lines := tagLines(t, "--tags", "", "testdata/build/compound.go")
+		if tagged := countPrefixed(lines, "testdata/build/compound.go,0") == 1; tagged != c.tagged {
+			t.Fatalf("For %s/%s got %v want %v", c.goos, c.goarch, tagged, c.tagged)
+		}
+	}
+}
+
+func TestGeneratedFiles(t *testing.T) {
+	files := []string{"testdata/generated.go", "testdata/nearmiss.go"}
+	lines := tagLines(t, files...)
+	if countPrefixed(lines, "testdata/generated.go,0") != 0 {
+		t.Fatalf("Generated file tagged: %q", lines)
+	}
+	if countPrefixed(lines, "testdata/nearmiss.go,0") != 1 || countPrefixed(lines, "func NearMiss") != 1 {
+		t.Fatalf("Near miss not tagged: %q", lines)
+	}
+	lines = tagLines(t, append([]string{"--include-generated"}, files...)...)
+	if countPrefixed(lines, "func Generated\x7FGenerated\x015,") != 1 {
+		t.Fatalf("Generated file not tagged with --include-generated: %q", lines)
+	}
+}
+
+// The offset of the first line is after the byte order mark, and later offsets are unaffected.
+func TestInputBom(t *testing.T) {
+	want := []string{
+		"\x0C",
+		"testdata/bom.go,0",
+		"package bom\x7Fbom\x011,3",
+		"func B\x7FB\x013,16",
+		"\x0C",
+		"testdata/bom.py,0",
+		"def f\x7Ff\x011,3",
+		"",
+	}
+	got := tagLines(t, "testdata/bom.go", "testdata/bom.py")
+	if !slices.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+}
+
+func TestKinds(t *testing.T) {
+	files := []string{"testdata/t1.go", "testdata/t4.py"}
+	kindCounts := func(args ...string) map[string]int {
+		var tags []struct{ Kind string }
+		lines := tagLines(t, slices.Concat([]string{"--format", "json"}, args, files)...)
+		if err := json.Unmarshal([]byte(strings.Join(lines, "\n")), &tags); err != nil {
+			t.Fatal(err)
+		}
+		counts := make(map[string]int)
+		for _, tag := range tags {
+			counts[tag.Kind]++
+		}
+		return counts
+	}
+	all := kindCounts()
+	for _, k := range []string{"package", "type", "const", "var", "func", "member"} {
+		if all[k] == 0 {
+			t.Fatalf("No %s tags: %v", k, all)
+		}
+	}
+	for _, kinds := range []string{"func,type", "const,var", "package"} {
+		want := make(map[string]int)
+		for _, k := range strings.Split(kinds, ",") {
+			want[k] = all[k]
+		}
+		if got := kindCounts("--kinds", kinds); !maps.Equal(got, want) {
+			t.Fatalf("With --kinds %s got %v want %v", kinds, got, want)
+		}
+	}
+	noMembers := maps.Clone(all)
+	delete(noMembers, "member")
+	if got := kindCounts("--no-members"); !maps.Equal(got, noMembers) {
+		t.Fatalf("With --no-members got %v want %v", got, noMembers)
+	}
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	if r := runMain([]string{"--kinds", "func,method", "testdata/t1.go"}); r == 0 {
+		t.Fatalf("Unknown kind accepted")
+	}
+}
+
+func TestPerDir(t *testing.T) {
+	dir, err := os.MkdirTemp("testdata", "perdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"a/x.go": "package a\n\nfunc X() {}\n",
+		"b/y.go": "package b\n\nfunc Y() {}\n",
+		"a/z.py": "def z():\n    pass\n",
+	}
+	var inputs []string
+	for _, fn := range []string{"a/x.go", "b/y.go", "a/z.py"} {
+		path := filepath.Join(dir, fn)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(files[fn]), 0666); err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, path)
+	}
+	var o2 strings.Builder
+	stderr = &o2
+	if r := runMain(append([]string{"--per-dir", "-o", "out/MYTAGS"}, inputs...)); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	want := map[string]string{
+		"a": "\x0C\nx.go,0\npackage a\x7Fa\x011,0\nfunc X\x7FX\x013,11\n" +
+			"\x0C\nz.py,0\ndef z\x7Fz\x011,0\n",
+		"b": "\x0C\ny.go,0\npackage b\x7Fb\x011,0\nfunc Y\x7FY\x013,11\n",
+	}
+	for sub, w := range want {
+		got, err := os.ReadFile(filepath.Join(dir, sub, "MYTAGS"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != w {
+			t.Fatalf("In %s got %q want %q", sub, got, w)
+		}
+	}
+	var o1 strings.Builder
+	stdout = &o1
+	if r := runMain(append([]string{"--per-dir", "-o", "-"}, inputs...)); r == 0 {
+		t.Fatalf("Per-directory output to stdout accepted")
+	}
+}
+
+func TestListFile(t *testing.T) {
+	var got []string
+	for _, l := range tagLines(t, "testdata/t1.go", "@testdata/paths.txt", "testdata/t2.go") {
+		if strings.HasPrefix(l, "testdata/") {
+			got = append(got, l)
+		}
+	}
+	want := []string{"testdata/t1.go,0", "testdata/t4.py,0", "testdata/mod/a.go,0", "testdata/t2.go,0"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	if r := runMain([]string{"-o", "-", "@testdata/nonexistent.txt"}); r == 0 {
+		t.Fatalf("Missing list file accepted")
+	}
+}
+
+func TestNullInput(t *testing.T) {
+	dir, err := os.MkdirTemp("testdata", "null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var names []string
+	for _, base := range []string{"with space.go", "with\nnewline.go"} {
+		fn := filepath.Join(dir, base)
+		if err := os.WriteFile(fn, []byte("package p\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, fn)
+	}
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	stdin = strings.NewReader(strings.Join(names, "\x00") + "\x00")
+	if r := runMain([]string{"-0", "-o", "-", "-"}); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	want := "\x0C\n" + names[0] + ",0\npackage p\x7Fp\x011,0\n" +
+		"\x0C\n" + names[1] + ",0\npackage p\x7Fp\x011,0\n"
+	if o1.String() != want {
+		t.Fatalf("Got %q want %q", o1.String(), want)
+	}
+}
+
+func TestIncremental(t *testing.T) {
+	dir, err := os.MkdirTemp("testdata", "incr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	past := time.Now().Add(-time.Hour)
+	write := func(base, text string, mtime time.Time) string {
+		fn := filepath.Join(dir, base)
+		if err := os.WriteFile(fn, []byte(text), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fn, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		return fn
+	}
+	a := write("a.go", "package p\n\nfunc A() {}\n", past)
+	b := write("b.go", "package p\n\nfunc B() {}\n", past)
+	c := write("c.go", "package p\n\nfunc C() {}\n", past)
+	tagsFn := filepath.Join(dir, "TAGS")
+	var o2 strings.Builder
+	stderr = &o2
+	run := func(inputs ...string) []string {
+		if r := runMain(append([]string{"--incremental", "-o", tagsFn}, inputs...)); r != 0 {
+			t.Fatalf("Exit code %d: %s", r, o2.String())
+		}
+		text, err := os.ReadFile(tagsFn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Split(string(text), "\x0C")
+	}
+	before := run(a, b, c)
+	// A's change is not seen because its modification time is older than the tags file's, which
+	// shows that its section is copied rather than regenerated.
+	write("a.go", "package p\n\nfunc AA() {}\n", past)
+	write("b.go", "package p\n\nfunc BB() {}\n", time.Now().Add(time.Hour))
+	after := run(a, b, c)
+	if len(after) != 4 || after[1] != before[1] || after[3] != before[3] {
+		t.Fatalf("Unchanged sections differ: %q, %q", before, after)
+	}
+	if !strings.Contains(after[2], "func BB\x7FBB") {
+		t.Fatalf("Changed section not regenerated: %q", after[2])
+	}
+	dropped := run(a, c)
+	if len(dropped) != 3 || dropped[1] != after[1] || dropped[2] != after[3] {
+		t.Fatalf("Removed file not dropped: %q", dropped)
+	}
+}
+
+// A failed run leaves the old tags file as it was and removes the new one.
+func TestAtomicOutput(t *testing.T) {
+	dir, err := os.MkdirTemp("testdata", "atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tagsFn := filepath.Join(dir, "TAGS")
+	refsFn := filepath.Join(dir, "REFS")
+	old := "\x0C\nold.go,0\npackage old\x7Fold\x011,0\n"
+	if err := os.WriteFile(tagsFn, []byte(old), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(refsFn, []byte(old), 0640); err != nil {
+		t.Fatal(err)
+	}
+	var o2 strings.Builder
+	stderr = &o2
+	args := []string{"--on-parse-error=fail", "--func-signature-refs", "--refs-output", refsFn,
+		"-o", tagsFn, "testdata/t1.go", "testdata/t2.go"}
+	if r := runMain(args); r == 0 {
+		t.Fatalf("Expected failure")
+	}
+	got, err := os.ReadFile(tagsFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != old {
+		t.Fatalf("Old tags file changed: %q", got)
+	}
+	if got, _ := os.ReadFile(refsFn); string(got) != old {
+		t.Fatalf("Old references file changed: %q", got)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Fatalf("Temporary file left behind: %v", entries)
+	}
+	// A directory without -R stops the input, and what was tagged before it is not a tags file.
+	args = []string{"-o", tagsFn, "testdata/t1.go", "testdata/tree", "testdata/generics.go"}
+	if r := runMain(args); r != 1 {
+		t.Fatalf("Exit code %d for a directory", r)
+	}
+	if got, _ := os.ReadFile(tagsFn); string(got) != old {
+		t.Fatalf("Old tags file changed by a directory: %q", got)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Fatalf("Temporary file left behind: %v", entries)
+	}
+	if r := runMain([]string{"-o", tagsFn, "testdata/t1.go"}); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	info, err := os.Stat(tagsFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Fatalf("Mode not preserved: %v", info.Mode())
+	}
+}
+
+func TestStdinName(t *testing.T) {
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	stdin = strings.NewReader("package buf\n\n// Unsaved.\nfunc Edited() {}\n")
+	if r := runMain([]string{"--stdin-name", "src/buf.go", "-o", "-"}); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	want := "\x0C\nsrc/buf.go,0\npackage buf\x7Fbuf\x011,0\nfunc Edited\x7FEdited\x014,25\n"
+	if o1.String() != want {
+		t.Fatalf("Got %q want %q", o1.String(), want)
+	}
+	if r := runMain([]string{"--stdin-name", "src/buf.go", "-o", "-", "testdata/t1.go"}); r == 0 {
+		t.Fatalf("Input files accepted with --stdin-name")
+	}
+}
+
+func TestResolveSymlinks(t *testing.T) {
+	lines := tagLines(t, "-q", "testdata/symlink.go")
+	if countPrefixed(lines, "testdata/symlink.go,0") != 1 {
+		t.Fatalf("Link not emitted verbatim: %q", lines)
+	}
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	args := []string{"--resolve-symlinks", "-o", "-", "testdata/symlink.go", "testdata/broken.go"}
+	if r := runMain(args); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	want := "\x0C\ntestdata/mod/a.go,0\npackage mod\x7Fmod\x011,0\nfunc A\x7FA\x013,13\n"
+	if o1.String() != want {
+		t.Fatalf("Got %q want %q", o1.String(), want)
+	}
+	if !strings.HasPrefix(o2.String(), "Skipping testdata/broken.go:") {
+		t.Fatalf("No warning for broken link: %q", o2.String())
+	}
+}
+
+func TestDuplicateInputs(t *testing.T) {
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	args := []string{"-o", "-", "testdata/t1.go", "testdata/t4.py", "./testdata/t1.go"}
+	if r := runMain(args); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	lines := strings.Split(o1.String(), "\n")
+	if countPrefixed(lines, "testdata/t1.go,0") != 1 || countPrefixed(lines, "./testdata/t1.go,0") != 0 {
+		t.Fatalf("Expected one section for t1.go: %q", lines)
+	}
+	if o2.String() != "Skipping duplicate input file ./testdata/t1.go\n" {
+		t.Fatalf("Unexpected warnings: %q", o2.String())
+	}
+	o2.Reset()
+	if r := runMain(append([]string{"-q"}, args...)); r != 0 || o2.String() != "" {
+		t.Fatalf("Warnings with -q: %q", o2.String())
+	}
+}
+
+func TestLiteralStructFields(t *testing.T) {
+	want := []string{
+		"\tHost\x7FHost\x014,39",
+		"\tPort\x7FPort\x015,52",
+		"var Defaults = &struct{ Timeout\x7FTimeout\x0111,101",
+	}
+	lines := tagLines(t, "testdata/literal.go")
+	for _, w := range want {
+		if !slices.Contains(lines, w) {
+			t.Fatalf("Missing %q in %q", w, lines)
+		}
+	}
+	lines = tagLines(t, "--no-members", "testdata/literal.go")
+	if countPrefixed(lines, "\tHost") != 0 {
+		t.Fatalf("Members tagged with --no-members: %q", lines)
+	}
+}
+
+func TestNestedContainerStructs(t *testing.T) {
+	want := []string{
+		"\tItems  []struct{ ID\x7FCatalog.Items.ID\x014,38",
+		"\tFixed  [4]struct{ Slot\x7FCatalog.Fixed.Slot\x015,65",
+		"\tLookup map[string]struct{ V\x7FCatalog.Lookup.V\x016,95",
+		"\tRef    *struct{ Target\x7FCatalog.Ref.Target\x017,130",
+		"\tDeep   []map[string]*struct{ Leaf\x7FCatalog.Deep.Leaf\x018,163",
+	}
+	lines := tagLines(t, "--qualified-members", "testdata/nested.go")
+	for _, w := range want {
+		if !slices.Contains(lines, w) {
+			t.Fatalf("Missing %q in %q", w, lines)
+		}
+	}
+}
+
+// The blank identifier is not tagged, whether the file is parsed or tagged with the builtin
+// patterns.
+func TestBlankIdentifier(t *testing.T) {
+	want := []string{
+		"\x0C",
+		"testdata/blank.go,0",
+		"package blank\x7Fblank\x011,0",
+		"var _, Kept\x7FKept\x017,51",
+		"type Padded\x7FPadded\x0113,100",
+		"\tWord\x7FWord\x0115,135",
+		"func (*Padded) String\x7FString\x0120,188",
+		"",
+	}
+	if got := tagLines(t, "testdata/blank.go"); !slices.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+	clearOptions()
+	var ft fileTags
+	builtinGoTags("x.go", "var _ = 1\nfunc _() {}\nconst _ = 2; var X int\n", &ft)
+	if len(ft.tags) != 1 || ft.tags[0].Name != "X" {
+		t.Fatalf("Blank identifier tagged by builtin patterns: %v", ft.tags)
+	}
+}
+
+func TestCharOffsets(t *testing.T) {
+	byteOffsets := []string{
+		"package multibyte\x7Fmultibyte\x012,79",
+		"type Ärger\x7FÄrger\x015,141",
+		"var Größe\x7FGröße\x017,158",
+		"func Maß\x7FMaß\x019,185",
+	}
+	charOffsets := []string{
+		"package multibyte\x7Fmultibyte\x012,76",
+		"type Ärger\x7FÄrger\x015,137",
+		"var Größe\x7FGröße\x017,153",
+		"func Maß\x7FMaß\x019,172",
+	}
+	if got := tagLines(t, "testdata/multibyte.go")[2:6]; !slices.Equal(got, byteOffsets) {
+		t.Fatalf("Got %q want %q", got, byteOffsets)
+	}
+	got := tagLines(t, "--char-offsets", "testdata/multibyte.go")[2:6]
+	if !slices.Equal(got, charOffsets) {
+		t.Fatalf("Got %q want %q", got, charOffsets)
+	}
+}
+
+func TestNoOffsets(t *testing.T) {
+	want := []string{
+		"package multibyte\x7Fmultibyte\x012,",
+		"type Ärger\x7FÄrger\x015,",
+		"var Größe\x7FGröße\x017,",
+		"func Maß\x7FMaß\x019,",
+	}
+	if got := tagLines(t, "--no-offsets", "testdata/multibyte.go")[2:6]; !slices.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+	for _, l := range tagLines(t, "--no-offsets", "testdata/t2.go", "testdata/t4.py") {
+		if strings.Contains(l, "\x01") && !strings.HasSuffix(l, ",") {
+			t.Fatalf("Record with offset: %q", l)
+		}
+	}
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	for _, arg := range []string{"--char-offsets", "--format=json", "--format=ctags"} {
+		if r := runMain([]string{"--no-offsets", arg, "-o", "-", "testdata/multibyte.go"}); r != 2 {
+			t.Fatalf("Exit code %d with %s", r, arg)
+		}
+	}
+}
+
+// A form feed in a source line does not end up in a pattern, where it would start a new tagsection.
+func TestPatternControlChars(t *testing.T) {
+	lines := tagLines(t, "testdata/formfeed.go", "testdata/formfeed.py")
+	sections := readSections(strings.Join(lines, "\n"))
+	if want := []string{"testdata/formfeed.go", "testdata/formfeed.py"}; !slices.Equal(
+		slices.Sorted(maps.Keys(sections)), want) {
+		t.Fatalf("Got sections %q want %q", slices.Sorted(maps.Keys(sections)), want)
+	}
+	for _, want := range []string{"var A, /* */ B\x7FB\x013,12", " def f\x7Ff\x012,9"} {
+		if !slices.Contains(lines, want) {
+			t.Fatalf("Missing %q in %q", want, lines)
+		}
+	}
+}
+
+// The native etags is run once per chunk of files, all chunks are run, and the exit code is that of
+// the first run that fails.  The fake etags records its runs and fails on b.c and d.c.
+// GOTAGS_ETAGS names the native etags, unless --etags is given, and may be empty.
+func TestEtagsEnv(t *testing.T) {
+	etags := filepath.Join(t.TempDir(), "etags")
+	script := `#!/bin/sh
+while read -r name || [ -n "$name" ]; do
+	printf '\f\n%s,0\nfrom env\n' "$name"
+done
+`
+	if err := os.WriteFile(etags, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOTAGS_ETAGS", etags)
+	if lines := tagLines(t, "testdata/t3.c"); !slices.Contains(lines, "from env") {
+		t.Fatalf("GOTAGS_ETAGS not run: %q", lines)
+	}
+	lines := tagLines(t, "--etags", defaultEtags, "testdata/t3.c")
+	if slices.Contains(lines, "from env") {
+		t.Fatalf("GOTAGS_ETAGS run despite --etags: %q", lines)
+	}
+	t.Setenv("GOTAGS_ETAGS", "")
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	if r := runMain([]string{"-v", "-o", "-", "testdata/t3.c"}); r != 0 || o1.String() != "" {
+		t.Fatalf("Exit code %d, output %q", r, o1.String())
+	}
+}
+
+// A native etags that can't be run leaves its files untagged, but the others are tagged.
+func TestMissingEtags(t *testing.T) {
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	args := []string{"--etags", "testdata/no-such-etags", "-o", "-", "testdata/t3.c", "testdata/t1.go"}
+	if r := runMain(args); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	sections := readSections(o1.String())
+	if _, found := sections["testdata/t1.go"]; !found || len(sections) != 1 {
+		t.Fatalf("Got %q", o1.String())
+	}
+	if !strings.Contains(o2.String(), "which could not be run") {
+		t.Fatalf("Got %q", o2.String())
+	}
+	o2.Reset()
+	if r := runMain(append([]string{"-q"}, args...)); r != 0 || o2.Len() != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+}
+
+func TestEtagsChunks(t *testing.T) {
+	dir, err := os.MkdirTemp("testdata", "chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	etags := filepath.Join(dir, "etags")
+	script := `#!/bin/sh
+echo run >> "$(dirname "$0")/runs"
+status=0
+while IFS= read -r name || [ -n "$name" ]; do
+	printf '\f\n%s,0\n' "$name"
+	case "$name" in
+	*b.c) [ $status = 0 ] && status=3 ;;
+	*d.c) [ $status = 0 ] && status=4 ;;
+	esac
+done
+exit $status
+`
+	if err := os.WriteFile(etags, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, n := range []string{"a.c", "b.c", "c.c", "d.c", "e.c"} {
+		names = append(names, filepath.Join(dir, n))
+	}
+	defer func(n int) { etagsChunkSize = n }(etagsChunkSize)
+	etagsChunkSize = 2
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	if r := runMain(append([]string{"--etags", etags, "-o", "-"}, names...)); r != 3 {
+		t.Fatalf("Exit code %d want 3: %s", r, o2.String())
+	}
+	var want string
+	for _, n := range names {
+		want += "\x0C\n" + n + ",0\n"
+	}
+	if o1.String() != want {
+		t.Fatalf("Got %q want %q", o1.String(), want)
+	}
+	runs, err := os.ReadFile(filepath.Join(dir, "runs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(runs), "run"); n != 3 {
+		t.Fatalf("Got %d runs want 3", n)
+	}
+}
+
+// The output of the native etags is streamed, so tagging allocates much less memory than the size of
+// that output.  The fake etags writes one million sections of 8 bytes.
+func TestEtagsStreaming(t *testing.T) {
+	dir, err := os.MkdirTemp("testdata", "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	etags := filepath.Join(dir, "etags")
+	script := "#!/bin/sh\nyes \"$(printf '\\f\\nx.c,0')\" | head -n 2000000\n"
+	if err := os.WriteFile(etags, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	clearOptions()
+	systemEtagsCommand = etags
+	nullOutput = true
+	out := &countingWriter{w: io.Discard}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if r := systemEtags([]string{"x.c"}, out, nil); r != 0 {
+		t.Fatalf("Exit code %d", r)
+	}
+	runtime.ReadMemStats(&after)
+	if want := int64(9 * 1000000); out.n != want {
+		t.Fatalf("Got %d bytes want %d", out.n, want)
+	}
+	// Streaming allocates a small fraction of the output, buffering it all would allocate more than
+	// all of it.  The race detector allocates much more, so the check is pointless then.
+	if alloc := after.TotalAlloc - before.TotalAlloc; !raceEnabled && alloc > uint64(out.n/4) {
+		t.Fatalf("Allocated %d bytes for %d bytes of output", alloc, out.n)
+	}
+}
+
+// raceEnabled is set when the tests are built with the race detector.
+var raceEnabled bool
+
+func TestSortOrder(t *testing.T) {
+	names := func(args ...string) []string {
+		var ns []string
+		for _, l := range tagLines(t, append(args, "testdata/sort.go")...) {
+			if _, after, found := strings.Cut(l, "\x7F"); found {
+				name, _, _ := strings.Cut(after, "\x01")
+				ns = append(ns, name)
+			}
+		}
+		return ns
+	}
+	declared := []string{"sort", "zeta", "Beta", "alpha", "Alpha", "Älg", "delta"}
+	if got := names(); !slices.Equal(got, declared) {
+		t.Fatalf("Got %q want %q", got, declared)
+	}
+	if got := names("--sort=line"); !slices.Equal(got, declared) {
+		t.Fatalf("Got %q want %q", got, declared)
+	}
+	byName := []string{"alpha", "Alpha", "Beta", "delta", "sort", "zeta", "Älg"}
+	if got := names("--sort=name"); !slices.Equal(got, byName) {
+		t.Fatalf("Got %q want %q", got, byName)
+	}
+	// Tags on the same line keep their order.
+	qualified := []string{"sort", "zeta", "Beta", "alpha", "Beta.alpha", "Alpha", "Älg", "delta"}
+	if got := names("--sort=line", "--qualified-members"); !slices.Equal(got, qualified) {
+		t.Fatalf("Got %q want %q", got, qualified)
+	}
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	if r := runMain([]string{"--sort=size", "-o", "-", "testdata/sort.go"}); r != 2 {
+		t.Fatalf("Exit code %d for unknown sort order", r)
+	}
+}
+
+func TestTestFiles(t *testing.T) {
+	files := []string{"testdata/foo.go", "testdata/foo_test.go", "testdata/t4.py", "testdata/t3.c"}
+	sections := func(args ...string) []string {
+		var ss []string
+		lines := tagLines(t, append(args, files...)...)
+		for i := 1; i < len(lines); i++ {
+			if lines[i-1] == "\x0C" {
+				name, _, _ := strings.Cut(lines[i], ",")
+				ss = append(ss, name)
+			}
+		}
+		return ss
+	}
+	want := []string{"testdata/foo.go", "testdata/t4.py", "testdata/t3.c"}
+	if got := sections("--no-tests"); !slices.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+	want = []string{"testdata/foo_test.go", "testdata/t4.py", "testdata/t3.c"}
+	if got := sections("--only-tests"); !slices.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	if r := runMain(append([]string{"--no-tests", "--only-tests", "-o", "-"}, files...)); r != 2 {
+		t.Fatalf("Exit code %d with both flags", r)
+	}
+}
+
+// The Go test files are tagged by the Go parser, even those with syntax errors, the Python file by
+// the builtin patterns and the C file by the native etags.  Every record of the output is a tag.
+func TestStats(t *testing.T) {
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	args := append([]string{"-q", "--stats", "-o", "-", "testdata/nonexistent.go"}, testFiles...)
+	if r := runMain(args); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	want := fmt.Sprintf(`Files tagged by the Go parser: 5
+Files tagged by builtin patterns: 1
+Files tagged by the native etags: 1
+Files skipped: 1
+Files reused from the previous tags file: 0
+Tags emitted: %d
+`, strings.Count(o1.String(), "\x7F"))
+	if o2.String() != want {
+		t.Fatalf("Got %q want %q", o2.String(), want)
+	}
+}
+
+func TestTimings(t *testing.T) {
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	args := append([]string{"-q", "--timings", "-o", "-"}, testFiles...)
+	if r := runMain(args); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	lines := strings.Split(o2.String(), "\n")
+	prefixes := []string{
+		"Total time: ",
+		"Time reading files: ",
+		"Time parsing Go: ",
+		"Time emitting tags: ",
+		"Time in the native etags: ",
+		"",
+	}
+	if len(lines) != len(prefixes) {
+		t.Fatalf("Got %q", lines)
+	}
+	for i, prefix := range prefixes {
+		if !strings.HasPrefix(lines[i], prefix) {
+			t.Fatalf("Got %q want prefix %q", lines[i], prefix)
+		}
+	}
+}
+
+func TestExcludeInclude(t *testing.T) {
+	files := []string{"testdata/foo.go", "testdata/foo_test.go", "testdata/t4.py", "testdata/t1.go"}
+	sections := func(args ...string) []string {
+		var ss []string
+		lines := tagLines(t, append(args, files...)...)
+		for i := 1; i < len(lines); i++ {
+			if lines[i-1] == "\x0C" {
+				name, _, _ := strings.Cut(lines[i], ",")
+				ss = append(ss, name)
+			}
+		}
+		return ss
+	}
+	want := []string{"testdata/foo.go", "testdata/t4.py", "testdata/t1.go"}
+	if got := sections("--exclude", `_test\.go$`); !slices.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+	want = []string{"testdata/foo.go", "testdata/foo_test.go", "testdata/t4.py"}
+	if got := sections("--include", "foo", "--include", `\.py$`); !slices.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+	want = []string{"testdata/foo.go", "testdata/t4.py"}
+	if got := sections("--include=foo", "--include=py", `--exclude=_test\.go$`); !slices.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	if r := runMain(append([]string{"--exclude", "(", "-o", "-"}, files...)); r != 2 {
+		t.Fatalf("Exit code %d for bad regexp", r)
+	}
+}
+
+// The declarations before a syntax error are tagged from the partial AST, with members, rather than
+// by the builtin patterns.
+func TestPartialAST(t *testing.T) {
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	if r := runMain([]string{"-o", "-", "testdata/late_error.go"}); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	lines := strings.Split(o1.String(), "\n")
+	for _, want := range []string{
+		"const Limit\x7FLimit\x013,14",
+		"\tName\x7FName\x016,53",
+		"\tLevel\x7FLevel\x017,67",
+		"func (c *Config) Valid\x7FValid\x0110,81",
+	} {
+		if !slices.Contains(lines, want) {
+			t.Fatalf("Missing %q in %q", want, lines)
+		}
+	}
+	if !strings.HasPrefix(o2.String(), "Tagging the parsed parts of testdata/late_error.go:") {
+		t.Fatalf("No warning: %q", o2.String())
+	}
+	lines = tagLines(t, "-q", "--on-parse-error=builtin", "testdata/late_error.go")
+	if countPrefixed(lines, "\tName") != 0 || countPrefixed(lines, "const Limit") != 1 {
+		t.Fatalf("Not tagged by the builtin patterns: %q", lines)
+	}
+}
+
+// The header precedes the first tagsection and the sections are otherwise unchanged.
+func TestHeader(t *testing.T) {
+	files := []string{"testdata/t1.go", "testdata/t4.py", "testdata/t3.c"}
+	plain := strings.Join(tagLines(t, append([]string{"-q"}, files...)...), "\n")
+	withHeader := strings.Join(tagLines(t, append([]string{"-q", "--header"}, files...)...), "\n")
+	first, rest, _ := strings.Cut(withHeader, "\n")
+	if first != "gotags "+VERSION+" format=etags" || rest != plain {
+		t.Fatalf("Bad header or sections: %q", withHeader)
+	}
+	if got, want := readSections(withHeader), readSections(plain); !maps.Equal(got, want) ||
+		len(got) != len(files) {
+		t.Fatalf("Got sections %q want %q", got, want)
+	}
+	lines := tagLines(t, "--header", "--format=ctags", "testdata/t1.go")
+	if lines[0] != "!_TAG_PROGRAM_NAME\tgotags\t//" ||
+		!strings.HasPrefix(lines[1], "!_TAG_PROGRAM_VERSION") {
+		t.Fatalf("No ctags pseudo-tags: %q", lines)
+	}
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	if r := runMain([]string{"--header", "--format=json", "-o", "-", "testdata/t1.go"}); r != 2 {
+		t.Fatalf("Exit code %d for --header with JSON", r)
+	}
+}
+
+func TestMembersOption(t *testing.T) {
+	members := func(args ...string) []string {
+		var names []string
+		lines := tagLines(t, append(args, "--format=ctags", "testdata/t1.go")...)
+		for _, l := range lines {
+			if strings.Contains(l, "\tkind:m\t") {
+				name, _, _ := strings.Cut(l, "\t")
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	all := members()
+	structs := members("--members=struct")
+	interfaces := members("--members", "interface")
+	for _, c := range []struct {
+		names     []string
+		in, notIn string
+	}{
+		{structs, "fld4", "if1"}, {structs, "Key", "Close"}, {structs, "named", "Abs"},
+		{interfaces, "if1", "fld4"}, {interfaces, "Close", "Key"}, {interfaces, "Abs", "named"},
+	} {
+		if !slices.Contains(c.names, c.in) || slices.Contains(c.names, c.notIn) {
+			t.Fatalf("Want %s but not %s in %q", c.in, c.notIn, c.names)
+		}
+	}
+	if len(structs)+len(interfaces) != len(all) {
+		t.Fatalf("Members %d + %d, want %d", len(structs), len(interfaces), len(all))
+	}
+	if got := members("--members", "interface,struct"); !slices.Equal(got, all) {
+		t.Fatalf("Got %q want %q", got, all)
+	}
+	if got := members("--members="); len(got) != 0 {
+		t.Fatalf("Got members %q", got)
+	}
+	if got := members("--no-members"); len(got) != 0 {
+		t.Fatalf("Got members %q", got)
+	}
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	if r := runMain([]string{"--members=union", "-o", "-", "testdata/t1.go"}); r != 2 {
+		t.Fatalf("Exit code %d for bad member type", r)
+	}
+}
+
+func TestAliasTargets(t *testing.T) {
+	plain := tagLines(t, "--format=ctags", "testdata/aliases.go")
+	lines := tagLines(t, "--alias-targets", "--format=ctags", "testdata/aliases.go")
+	var extra []string
+	for _, l := range lines {
+		if !slices.Contains(plain, l) {
+			extra = append(extra, l)
+		}
+	}
+	want := []string{
+		"Name\ttestdata/aliases.go\t/^\tLocal = Name/;\"\tkind:t\tend:135",
+		"PathError\ttestdata/aliases.go\t/^type MyError = fs.PathError/;\"\tkind:t\tend:80",
+	}
+	if !slices.Equal(extra, want) || len(lines) != len(plain)+len(want) {
+		t.Fatalf("Got extra tags %q want %q", extra, want)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dir := t.TempDir()
+	outname := filepath.Join(dir, "TAGS")
+	logname := filepath.Join(dir, "sections")
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	args := []string{"--dry-run", "--on-parse-error=builtin", "-o", outname, "--debug-sections",
+		logname, "testdata/t1.go", "testdata/t2.go", "testdata/t4.py", "testdata/t3.c"}
+	if r := runMain(args); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	for _, fn := range []string{outname, logname} {
+		if _, err := os.Stat(fn); !os.IsNotExist(err) {
+			t.Fatalf("Output file %s written: %v", fn, err)
+		}
+	}
+	for _, want := range []string{
+		"testdata/t1.go: gotags, ",
+		"Reverting to etags parsing for testdata/t2.go",
+		"testdata/t2.go: builtin, ",
+		"testdata/t4.py: builtin, ",
+		"testdata/t3.c: native\n",
+	} {
+		if !strings.Contains(o2.String(), want) {
+			t.Fatalf("No %q in %q", want, o2.String())
+		}
+	}
+	if o1.Len() != 0 {
+		t.Fatalf("Output %q", o1.String())
+	}
+}
+
+// A writer that can be read while another goroutine writes to it.
+type syncBuilder struct {
+	mu sync.Mutex
+	sb strings.Builder
+}
+
+func (s *syncBuilder) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sb.Write(p)
+}
+
+func (s *syncBuilder) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sb.String()
+}
+
+// A reader that yields its first chunk immediately and the rest only once released.
+type throttledReader struct {
+	first, rest string
+	release     chan struct{}
+	state       int
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	switch r.state {
+	case 0:
+		r.state++
+		return copy(p, r.first), nil
+	case 1:
+		<-r.release
+		r.state++
+		return copy(p, r.rest), nil
+	default:
+		return 0, io.EOF
+	}
+}
+
+// A reader that returns one line per read and closes drained when all have been read.
+type lineReader struct {
+	lines   []string
+	drained chan struct{}
+	closed  bool
+}
+
+func (r *lineReader) Read(p []byte) (int, error) {
+	if len(r.lines) == 0 {
+		if !r.closed {
+			close(r.drained)
+			r.closed = true
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, r.lines[0]+"\n")
+	r.lines = r.lines[1:]
+	return n, nil
+}
+
+// A writer whose writes block until release is closed.
+type blockedWriter struct {
+	b       strings.Builder
+	release chan struct{}
+}
+
+func (w *blockedWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return w.b.Write(p)
+}
+
+// A reader that closes a channel when it is first read, as if a signal arrived then.
+type interruptingReader struct {
+	r         io.Reader
+	interrupt chan struct{}
+}
+
+func (r *interruptingReader) Read(p []byte) (int, error) {
+	if r.interrupt != nil {
+		close(r.interrupt)
+		r.interrupt = nil
+	}
+	return r.r.Read(p)
+}
+
+// The first file is tagged and written before the interrupt, which arrives while the name of the
+// second is read.
+func TestInterrupt(t *testing.T) {
+	defer func() { interrupted = nil }()
+	run := func(args ...string) {
+		interrupted = make(chan struct{})
+		stdin = io.MultiReader(
+			strings.NewReader("testdata/t1.go\n"),
+			&interruptingReader{strings.NewReader("testdata/t4.py\n"), interrupted},
+		)
+		var o1, o2 strings.Builder
+		stdout = &o1
+		stderr = &o2
+		if r := runMain(append(args, "-")); r != exitInterrupted {
+			t.Fatalf("Exit code %d: %s", r, o2.String())
+		}
+		if !strings.Contains(o2.String(), "Interrupted") {
+			t.Fatalf("No message: %s", o2.String())
+		}
+	}
+	dir := t.TempDir()
+	outname := filepath.Join(dir, "TAGS")
+	refsname := filepath.Join(dir, "REFS")
+	run("-o", outname, "--func-signature-refs", "--refs-output", refsname)
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Fatalf("Stale files %v: %v", entries, err)
+	}
+	if err := os.WriteFile(outname, []byte("old"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	run("-o", outname, "--append")
+	if text, err := os.ReadFile(outname); err != nil || string(text) != "old" {
+		t.Fatalf("Got %q: %v", text, err)
+	}
+	if err := os.WriteFile(refsname, []byte("old refs"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	run("-o", outname, "--func-signature-refs", "--refs-output", refsname)
+	if text, err := os.ReadFile(outname); err != nil || string(text) != "old" {
+		t.Fatalf("Got %q: %v", text, err)
+	}
+	if text, err := os.ReadFile(refsname); err != nil || string(text) != "old refs" {
+		t.Fatalf("Got references %q: %v", text, err)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 2 {
+		t.Fatalf("Stale files %v: %v", entries, err)
+	}
+}
+
+// With --jobs-stdin, files whose names have arrived are tagged before stdin is closed.
+func TestJobsStdin(t *testing.T) {
+	release := make(chan struct{})
+	stdin = &throttledReader{first: "testdata/t1.go\n", rest: "testdata/t4.py\n", release: release}
+	var o1 syncBuilder
+	var o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	done := make(chan int)
+	go func() {
+		done <- runMain([]string{"--jobs-stdin", "-o", "-", "-"})
+	}()
+	deadline := time.Now().Add(10 * time.Second)
+	for !strings.Contains(o1.String(), "\x0C\x0Atestdata/t1.go,0") {
+		if time.Now().After(deadline) {
+			close(release)
+			t.Fatalf("First file not tagged while stdin was open")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if strings.Contains(o1.String(), "testdata/t4.py") {
+		t.Fatalf("Second file tagged before its name was read")
+	}
+	close(release)
+	if r := <-done; r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	if !strings.Contains(o1.String(), "\x0C\x0Atestdata/t4.py,0") {
+		t.Fatalf("Second file not tagged")
+	}
+
+	// Nor does tagging stall the producer: with the output blocked, the names are still read,
+	// which they are not without --jobs-stdin.
+	for _, readAhead := range []bool{true, false} {
+		names := []string{"testdata/t1.go"}
+		for i := range 20 {
+			names = append(names, fmt.Sprintf("testdata/missing%d.go", i))
+		}
+		r := &lineReader{lines: names, drained: make(chan struct{})}
+		w := &blockedWriter{release: make(chan struct{})}
+		stdin = r
+		stdout = w
+		args := []string{"-q", "-o", "-", "-"}
+		if readAhead {
+			args = append([]string{"--jobs-stdin"}, args...)
+		}
+		go func() {
+			done <- runMain(args)
+		}()
+		select {
+		case <-r.drained:
+			if !readAhead {
+				t.Fatalf("Names read ahead without --jobs-stdin")
+			}
+		case <-time.After(time.Second):
+			if readAhead {
+				t.Fatalf("Names not read ahead with --jobs-stdin")
+			}
+		}
+		close(w.release)
+		if code := <-done; code != 0 {
+			t.Fatalf("Exit code %d", code)
+		}
+		if !strings.Contains(w.b.String(), "\x0C\x0Atestdata/t1.go,0") {
+			t.Fatalf("File not tagged: %q", w.b.String())
+		}
+	}
+}
+
+// Run gotags with the given arguments, writing tags to stdout, and return the output lines.
+func tagLines(t *testing.T, args ...string) []string {
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	if r := runMain(append([]string{"-o", "-"}, args...)); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	return strings.Split(o1.String(), "\n")
+}
+
+// Count the output lines that have the given prefix.
+func countPrefixed(lines []string, prefix string) int {
+	n := 0
+	for _, l := range lines {
+		if strings.HasPrefix(l, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestInlineInterfaceMethods(t *testing.T) {
+	serve := "\tHandler interface{ Serve\x7FServe\x014,"
+	log := "\t\tLog\x7FLog\x017,"
+	lines := tagLines(t, "testdata/inline.go")
+	if countPrefixed(lines, serve) != 0 || countPrefixed(lines, log) != 0 {
+		t.Fatalf("Inline methods tagged without flag: %q", lines)
+	}
+	lines = tagLines(t, "--inline-interface-methods", "testdata/inline.go")
+	if countPrefixed(lines, serve) != 1 || countPrefixed(lines, log) != 1 {
+		t.Fatalf("Inline methods not tagged with flag: %q", lines)
+	}
+	if countPrefixed(lines, "\t\tfmt.Stringer") != 0 {
+		t.Fatalf("Embedded interface tagged as method: %q", lines)
+	}
+}
+
+// The method of an inline interface constraint is not a member, and the constraint has no fields.
+func TestInlineConstraint(t *testing.T) {
+	want := []string{
+		"\x0C",
+		"testdata/constraint.go,0",
+		"package constraint\x7Fconstraint\x011,0",
+		"func F\x7FF\x014,101",
+		"",
+	}
+	for _, args := range [][]string{
+		{},
+		{"--func-signature-refs", "--refs-output", "/dev/null"},
+		{"--inline-interface-methods"},
+		{"--inline-interface-methods", "--func-signature-refs", "--refs-output", "/dev/null"},
+	} {
+		if got := tagLines(t, append(args, "testdata/constraint.go")...); !slices.Equal(got, want) {
+			t.Fatalf("Got %q want %q with %q", got, want, args)
+		}
+	}
+}
+
+func TestDumpAst(t *testing.T) {
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	if r := runMain([]string{"-o", "/dev/null", "testdata/inline.go"}); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	if strings.Contains(o2.String(), "AST for") {
+		t.Fatalf("AST dumped without flag")
+	}
+	if r := runMain([]string{"--dump-ast", "-o", "/dev/null", "testdata/inline.go"}); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	dump := o2.String()
+	if !strings.Contains(dump, "AST for testdata/inline.go:") ||
+		!strings.Contains(dump, "*ast.File {") ||
+		!strings.Contains(dump, `Name: "Server"`) {
+		t.Fatalf("Missing AST dump: %s", dump)
+	}
+}
+
+func TestReadmeTags(t *testing.T) {
+	inBytes, err := os.ReadFile("testdata/readme.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inLines := strings.Split(string(inBytes), "\n")
+	// Expected tag records for pattern prefixes, which identify their lines uniquely.
+	expect := func(pattern, name string) string {
+		ix := 0
+		for i, l := range inLines {
+			if strings.HasPrefix(l, pattern) {
+				return fmt.Sprintf("%s\x7F%s\x01%d,%d", pattern, name, i+1, ix)
+			}
+			ix += len(l) + 1
+		}
+		t.Fatalf("No line for %s", pattern)
+		return ""
+	}
+	want := []string{
+		expect("type Widget", "Widget"),
+		expect("\tSize", "Size"),
+		expect("func NewWidget", "NewWidget"),
+		expect("package demo", "demo"),
+		expect("const Limit", "Limit"),
+	}
+	lines := tagLines(t, "-q", "--include-readme-tags", "testdata/readme.md")
+	if len(lines) != len(want)+3 || lines[1] != "testdata/readme.md,0" {
+		t.Fatalf("Bad output: %q", lines)
+	}
+	for i, w := range want {
+		if lines[i+2] != w {
+			t.Fatalf("Got %q want %q", lines[i+2], w)
+		}
+	}
+}
+
+func TestFuncSignatureRefs(t *testing.T) {
+	refsFile, err := os.CreateTemp("", "refs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refsFile.Close()
+	defer os.Remove(refsFile.Name())
+	lines := tagLines(
+		t, "--func-signature-refs", "--refs-output", refsFile.Name(), "testdata/refs.go")
+	if countPrefixed(lines, "func New(opts *Options) (*Server") != 0 {
+		t.Fatalf("References in tags file: %q", lines)
+	}
+	refsBytes, err := os.ReadFile(refsFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"\x0C",
+		"testdata/refs.go,0",
+		"func New(opts *Options\x7FOptions\x017,59",
+		"func New(opts *Options) (*Server\x7FServer\x017,59",
+		"func Serve[T any](s []Server\x7FServer\x019,121",
+		"func Serve[T any](s []Server, xs ...T) chan<- io.Reader\x7FReader\x019,121",
+		"",
+	}
+	if got := strings.Split(string(refsBytes), "\n"); !slices.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+}
+
+// With --null-output every section, including those from the native etags, is followed by NUL.
+func TestNullOutput(t *testing.T) {
+	files := []string{"testdata/t1.go", "testdata/t4.py", "testdata/t3.c"}
+	lines := tagLines(t, append([]string{"-q"}, files...)...)
+	if slices.ContainsFunc(lines, func(l string) bool { return strings.Contains(l, "\x00") }) {
+		t.Fatalf("NUL in output without flag")
+	}
+	var o1 strings.Builder
+	stdout = &o1
+	if r := runMain(append([]string{"-q", "--null-output", "-o", "-"}, files...)); r != 0 {
+		t.Fatalf("Exit code %d", r)
+	}
+	sections := strings.Split(o1.String(), "\x00")
+	if len(sections) != len(files)+1 || sections[len(files)] != "" {
+		t.Fatalf("Bad NUL separation: %q", sections)
+	}
+	for i, f := range files {
+		if !strings.HasPrefix(sections[i], "\x0C\x0A"+f+",") || !strings.HasSuffix(sections[i], "\x0A") {
+			t.Fatalf("Bad section %d: %q", i, sections[i])
+		}
+	}
+}
+
+func TestCoalesceFields(t *testing.T) {
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	files := []string{"testdata/config_unix.go", "testdata/config_windows.go"}
+	if r := runMain(append([]string{"-o", "/dev/null"}, files...)); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	if o2.String() != "" {
+		t.Fatalf("Warnings without flag: %s", o2.String())
+	}
+	if r := runMain(append([]string{"--coalesce-fields", "-o", "/dev/null"}, files...)); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	want := "Type Config in testdata/config_windows.go lacks fields present in " +
+		"testdata/config_unix.go: Uid, Socket\n" +
+		"Type Config in testdata/config_windows.go has fields not present in " +
+		"testdata/config_unix.go: Pipe\n"
+	if o2.String() != want {
+		t.Fatalf("Got %q want %q", o2.String(), want)
+	}
+	// The Config of another package is not compared to these.
+	o2.Reset()
+	files = append(files, "testdata/server/config.go")
+	if r := runMain(append([]string{"--coalesce-fields", "-o", "/dev/null"}, files...)); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	if o2.String() != want {
+		t.Fatalf("Got %q want %q", o2.String(), want)
+	}
+	o2.Reset()
+	if r := runMain(append([]string{"-q", "--coalesce-fields", "-o", "/dev/null"}, files...)); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	if o2.String() != "" {
+		t.Fatalf("Warnings with -q: %s", o2.String())
+	}
+}
+
+// Packages are resolved by the go command, which excludes test files and files excluded by build
+// constraints.
+func TestPackages(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir("testdata/mod"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	var headers []string
+	lines := tagLines(t, "--packages", "./...")
+	for i, l := range lines[:len(lines)-1] {
+		if l == "\x0C" {
+			headers = append(headers, strings.TrimSuffix(lines[i+1], ",0"))
+		}
+	}
+	if want := []string{"a.go", "sub/b.go"}; !slices.Equal(headers, want) {
+		t.Fatalf("Got %q want %q", headers, want)
+	}
+}
+
+// The plugin sees the candidates and drops the tags named main.
+func TestFilterPlugin(t *testing.T) {
+	candidates, err := os.CreateTemp("", "candidates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates.Close()
+	defer os.Remove(candidates.Name())
+	plugin := fmt.Sprintf("tee %s | grep -v '^main\t'", candidates.Name())
+	lines := tagLines(t, "--filter-plugin", plugin, "testdata/t1.go")
+	if countPrefixed(lines, "package  main\x7F") != 0 {
+		t.Fatalf("Tag for main not dropped: %q", lines)
+	}
+	if countPrefixed(lines, "type t4\x7Ft4\x019,") != 1 {
+		t.Fatalf("Other tags dropped: %q", lines)
+	}
+	seen, err := os.ReadFile(candidates.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []string{"main\ttestdata/t1.go\t2\tpackage\n", "fld1\ttestdata/t1.go\t10\tmember\n"} {
+		if !strings.Contains(string(seen), c) {
+			t.Fatalf("Plugin did not see %q: %q", c, seen)
+		}
+	}
+}
+
+func TestOutputLineEndings(t *testing.T) {
+	lines := tagLines(t, "--output-line-endings=lf", "testdata/t1.go")
+	if countPrefixed(lines, "testdata/t1.go,0") != 1 {
+		t.Fatalf("Bad output: %q", lines)
+	}
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	if r := runMain([]string{"--output-line-endings=crlf", "testdata/t1.go"}); r != 2 {
+		t.Fatalf("Exit code %d", r)
+	}
+	if !strings.Contains(o2.String(), "CRLF would corrupt it") {
+		t.Fatalf("Missing explanation: %s", o2.String())
+	}
+	lines = tagLines(t, "--format=ctags", "--header", "--output-line-endings=crlf", "testdata/t1.go")
+	if len(lines) < 3 || lines[len(lines)-1] != "" {
+		t.Fatalf("Bad output: %q", lines)
+	}
+	for _, l := range lines[:len(lines)-1] {
+		if !strings.HasSuffix(l, "\r") || strings.Count(l, "\r") != 1 {
+			t.Fatalf("Line without CRLF ending: %q", l)
+		}
+	}
+}
+
+func TestSuppressSectionForErrors(t *testing.T) {
+	files := []string{"testdata/t1.go", "testdata/t2.go", "testdata/t4.py"}
+	lines := tagLines(t, append([]string{"-q"}, files...)...)
+	if countPrefixed(lines, "testdata/t2.go,0") != 1 {
+		t.Fatalf("No fallback section: %q", lines)
+	}
+	lines = tagLines(t, append([]string{"-q", "--suppress-section-for-errors"}, files...)...)
+	if countPrefixed(lines, "testdata/t2.go,0") != 0 || countPrefixed(lines, "package Pack") != 0 {
+		t.Fatalf("Section for unparseable file: %q", lines)
+	}
+	if countPrefixed(lines, "testdata/t1.go,0") != 1 || countPrefixed(lines, "testdata/t4.py,0") != 1 {
+		t.Fatalf("Sections missing: %q", lines)
+	}
+}
+
+func TestMethodTypeRefs(t *testing.T) {
+	refsFile, err := os.CreateTemp("", "refs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refsFile.Close()
+	defer os.Remove(refsFile.Name())
+	tagLines(t, "--method-type-refs", "--refs-output", refsFile.Name(), "testdata/methods.go")
+	refsBytes, err := os.ReadFile(refsFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"\x0C",
+		"testdata/methods.go,0",
+		"func (t T\x7FT\x015,41",
+		"func (t *T\x7FT\x017,86",
+		"func (*T\x7FT\x019,114",
+		"",
+	}
+	if got := strings.Split(string(refsBytes), "\n"); !slices.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+}
+
+// Each line of the section log gives the offset of a section's FF and how it was produced.
+func TestDebugSections(t *testing.T) {
+	logFile, err := os.CreateTemp("", "sections")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logFile.Close()
+	defer os.Remove(logFile.Name())
+	var o1 strings.Builder
+	stdout = &o1
+	files := []string{"testdata/t1.go", "testdata/t2.go", "testdata/t4.py", "testdata/t3.c"}
+	args := append([]string{"-q", "--output-bom", "--debug-sections", logFile.Name(), "-o", "-"}, files...)
+	if r := runMain(args); r != 0 {
+		t.Fatalf("Exit code %d", r)
+	}
+	output := o1.String()
+	logBytes, err := os.ReadFile(logFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	origins := []string{"gotags", "gotags", "builtin", "native"}
+	entries := strings.Split(strings.TrimSuffix(string(logBytes), "\n"), "\n")
+	if len(entries) != len(files) {
+		t.Fatalf("Bad log: %q", entries)
+	}
+	for i, e := range entries {
+		var offset int
+		var origin, name string
+		if _, err := fmt.Sscanf(e, "%d\t%s\t%s", &offset, &origin, &name); err != nil {
+			t.Fatalf("Bad log entry %q: %v", e, err)
+		}
+		if origin != origins[i] || name != files[i] {
+			t.Fatalf("Bad log entry %q", e)
+		}
+		if !strings.HasPrefix(output[offset:], "\x0C\x0A"+files[i]+",") {
+			t.Fatalf("Offset %d is not the start of the section for %s", offset, files[i])
+		}
+	}
+}
+
+func TestAnonymousFuncs(t *testing.T) {
+	want := []string{
+		"var OnStart = func\x7Ffunc@testdata/anon.go:3\x013,14",
+		"\tOnClick: func\x7Ffunc@testdata/anon.go:8\x018,113",
+	}
+	lines := tagLines(t, "testdata/anon.go")
+	if slices.ContainsFunc(lines, func(l string) bool { return strings.Contains(l, "func@") }) {
+		t.Fatalf("Synthetic tags without flag: %q", lines)
+	}
+	lines = tagLines(t, "--tag-anonymous-funcs-by-position", "testdata/anon.go")
+	var got []string
+	for _, l := range lines {
+		if strings.Contains(l, "func@") {
+			got = append(got, l)
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+	// With --relative the synthetic names have the file name of their section.
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	dir, err := os.MkdirTemp("testdata", "anon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tagsFn := filepath.Join(dir, "TAGS")
+	args := []string{"--relative", "--tag-anonymous-funcs-by-position", "-o", tagsFn,
+		"testdata/anon.go"}
+	if r := runMain(args); r != 0 {
+		t.Fatalf("Exit code %d: %s", r, o2.String())
+	}
+	text, err := os.ReadFile(tagsFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(text), "\x0C\n../anon.go,0\n") ||
+		!strings.Contains(string(text), "\x7Ffunc@../anon.go:3\x01") {
+		t.Fatalf("Synthetic names not relative: %q", text)
+	}
+}
+
+// Without --merge-adjacent-sections a file input twice is skipped the second time, with a warning,
+// with it the file is tagged twice and the tags are merged into the first section.
+func TestMergeAdjacentSections(t *testing.T) {
+	once := tagLines(t, "testdata/t1.go")
+	files := []string{"testdata/t1.go", "testdata/t4.py", "./testdata/t1.go"}
+	for _, merge := range []bool{false, true} {
+		var o1, o2 strings.Builder
+		stdout = &o1
+		stderr = &o2
+		args := append([]string{"-o", "-", "--stats"}, files...)
+		if merge {
+			args = append([]string{"--merge-adjacent-sections"}, args...)
+		}
+		if r := runMain(args); r != 0 {
+			t.Fatalf("Exit code %d: %s", r, o2.String())
+		}
+		lines := strings.Split(o1.String(), "\n")
+		if countPrefixed(lines, "testdata/t1.go,0") != 1 ||
+			countPrefixed(lines, "./testdata/t1.go,0") != 0 ||
+			countPrefixed(lines, "testdata/t4.py,0") != 1 {
+			t.Fatalf("Expected one section per file: %q", lines)
+		}
+		if !slices.Equal(lines[:len(once)-1], once[:len(once)-1]) {
+			t.Fatalf("Merged section differs from single section")
+		}
+		warned := strings.Contains(o2.String(), "Skipping duplicate input file ./testdata/t1.go")
+		parsedTwice := strings.Contains(o2.String(), "Files tagged by the Go parser: 2")
+		if warned == merge || parsedTwice != merge {
+			t.Fatalf("With merging %v: %s", merge, o2.String())
+		}
+	}
+}
+
+func TestOnParseError(t *testing.T) {
+	files := []string{"testdata/t1.go", "testdata/t2.go", "testdata/t4.py"}
+	lines := tagLines(t, append([]string{"-q", "--on-parse-error=fallback"}, files...)...)
+	if countPrefixed(lines, "testdata/t2.go,0") != 1 || countPrefixed(lines, "package Pack") != 1 {
+		t.Fatalf("No fallback tags: %q", lines)
+	}
+	// The parser makes up a name for a declaration that is cut off at the end of the file, which is
+	// not tagged.
+	lines = tagLines(t, "-q", "--on-parse-error=fallback", "testdata/truncated.go")
+	want := []string{
+		"\x0C",
+		"testdata/truncated.go,0",
+		"package truncated\x7Ftruncated\x011,0",
+		"func Complete\x7FComplete\x013,19",
+		"var V\x7FV\x015,39",
+		"",
+	}
+	if !slices.Equal(lines, want) {
+		t.Fatalf("Got %q want %q", lines, want)
+	}
+	lines = tagLines(t, append([]string{"-q", "--on-parse-error=skip"}, files...)...)
+	if countPrefixed(lines, "testdata/t2.go,0") != 0 || countPrefixed(lines, "testdata/t4.py,0") != 1 {
+		t.Fatalf("Unparseable file not skipped: %q", lines)
+	}
+	var o1, o2 strings.Builder
+	stdout = &o1
+	stderr = &o2
+	if r := runMain(append([]string{"-q", "--on-parse-error=fail", "-o", "-"}, files...)); r != 1 {
+		t.Fatalf("Exit code %d", r)
+	}
+	if !strings.Contains(o2.String(), "Could not parse testdata/t2.go") {
+		t.Fatalf("No error message: %s", o2.String())
+	}
+	if r := runMain([]string{"--on-parse-error=ignore", "testdata/t1.go"}); r != 2 {
+		t.Fatalf("Bad action accepted: %d", r)
+	}
+}
+
+// TestTagging checks the offsets for CRLF files, this checks that no CR leaks into the patterns.
+func TestCRLF(t *testing.T) {
+	for _, l := range tagLines(t, "-q", "testdata/crlf.go", "testdata/crlf2.go") {
+		if strings.Contains(l, "\r") {
+			t.Fatalf("CR in output: %q", l)
+		}
+	}
+}
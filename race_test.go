@@ -0,0 +1,9 @@
+// SPDX-License-Identifier: MIT
+
+//go:build race
+
+package main
+
+func init() {
+	raceEnabled = true
+}
@@ -0,0 +1,584 @@
+// SPDX-License-Identifier: MIT
+
+// Package tags computes the tags of Go source text: the names declared at the top level of a file,
+// the members of its struct and interface types, and optionally references to named types.  It is
+// the core of the gotags program, which formats the tags it computes as etags or ctags files.
+package tags
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"slices"
+	"strings"
+)
+
+// A Tag is one definition of a name.  The Pattern runs from the start of the line of the definition
+// through the name, Line is one-based, and Offset is the zero-based byte offset of the start of the
+// line, or -1 if it is not known.  EndOffset is the offset just past the name, Offset plus the
+// length of the Pattern, or -1.  For a method, Receiver is the name of the receiver type, without
+// pointer or type arguments.  With EnumScope, Scope is the named type of a constant.
+type Tag struct {
+	Name      string
+	Kind      string
+	Line      int
+	Offset    int
+	EndOffset int
+	Pattern   string
+	Receiver  string
+	Scope     string
+}
+
+// Tag kinds.  Those that name Go declarations are the same as the declaring keyword.  A struct field
+// of function type is a method-field rather than a member, but it is selected as a member.
+const (
+	KindPackage     = "package"
+	KindType        = "type"
+	KindConst       = "const"
+	KindVar         = "var"
+	KindFunc        = "func"
+	KindMember      = "member"
+	KindImport      = "import"
+	KindLinkname    = "linkname"
+	KindMethodField = "method-field"
+)
+
+// Options select the tags that are computed.  The zero value computes tags of every kind except
+// imports and linknames, and no references.
+type Options struct {
+	// Kinds is the set of kinds to tag, or nil for all kinds.
+	Kinds map[string]bool
+
+	// ExportedOnly drops the tags for unexported names, except the package tag.
+	ExportedOnly bool
+
+	// QualifiedMembers also tags each member as Type.member.
+	QualifiedMembers bool
+
+	// NoStructMembers leaves out the fields of struct types, and NoInterfaceMembers the methods and
+	// embedded interfaces of interface types.
+	NoStructMembers    bool
+	NoInterfaceMembers bool
+
+	// InlineMethods tags the methods of interface types nested in struct types.
+	InlineMethods bool
+
+	// AnonFuncs tags function literals assigned to exported variables or exported fields in
+	// composite literals, under synthetic names "func@file:line".
+	AnonFuncs bool
+
+	// Imports tags the local names given to imported packages, other than _ and ".".
+	Imports bool
+
+	// EnumScope sets the Scope of a constant to its type, if that is a named type, as Pill for
+	// Placebo and Aspirin in const ( Placebo Pill = iota; Aspirin ).
+	EnumScope bool
+
+	// Linknames tags the local name of each //go:linkname directive in the file's comments, at the
+	// directive, and requires the file to be parsed with parser.ParseComments.  The remote name
+	// belongs to another package and is not tagged.
+	Linknames bool
+
+	// AliasTargets also tags the target of a type alias, when it is a plain or qualified name, at
+	// the alias declaration, as in type MyError = pkg.Error.
+	AliasTargets bool
+
+	// SignatureRefs records references to the named types in function signatures.
+	SignatureRefs bool
+
+	// ReceiverRefs records references to the receiver types of methods.
+	ReceiverRefs bool
+}
+
+// A Struct is a named struct type declared at the top level of a file.
+type Struct struct {
+	Name string
+	Type *ast.StructType
+}
+
+// A File holds the tags and references computed for one source file, and its struct types.
+type File struct {
+	Tags    []Tag
+	Refs    []Tag
+	Structs []Struct
+}
+
+// TagsForFile parses src as the Go source file filename and returns its tags of all kinds, or the
+// parse error.
+func TagsForFile(filename string, src []byte) ([]Tag, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filename, src, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+	var opts Options
+	return opts.FileTags(fset, filename, string(src), f).Tags, nil
+}
+
+// FileTags computes the tags of f, parsed from src with fset.  The filename is used only in the
+// synthetic names of AnonFuncs, and can differ from the name f was parsed as, for example to be
+// relative to the directory of a tags file.
+func (opts *Options) FileTags(fset *token.FileSet, filename, src string, f *ast.File) *File {
+	ft := &fileTags{opts: opts, fset: fset}
+	ft.addTag(src, "", f.Name, KindPackage)
+	ft.declTags(filename, src, f.Decls)
+	if opts.Linknames {
+		n := len(ft.Tags)
+		ft.linknameTags(src, f.Comments)
+		ft.Tags = append(ft.Tags[:n], opts.Filter(ft.Tags[n:])...)
+	}
+	return &ft.File
+}
+
+// DeclTags is like FileTags but computes only the tags of decls, not the package tag.
+func (opts *Options) DeclTags(fset *token.FileSet, filename, src string, decls []ast.Decl) *File {
+	ft := &fileTags{opts: opts, fset: fset}
+	ft.declTags(filename, src, decls)
+	return &ft.File
+}
+
+// Filter removes the tags for the blank identifier, the tags whose kinds are not selected and, with
+// ExportedOnly, the tags for unexported names.  A qualified name is judged by its last component.
+// Synthetic names are not identifiers and are kept.
+func (opts *Options) Filter(tags []Tag) []Tag {
+	return slices.DeleteFunc(tags, func(t Tag) bool {
+		if !opts.kind(t.Kind) {
+			return true
+		}
+		name := t.Name[strings.LastIndexByte(t.Name, '.')+1:]
+		if name == "_" {
+			return true
+		}
+		return opts.ExportedOnly && t.Kind != KindPackage && token.IsIdentifier(name) &&
+			!token.IsExported(name)
+	})
+}
+
+func (opts *Options) kind(kind string) bool {
+	if kind == KindMethodField {
+		kind = KindMember
+	}
+	return opts.Kinds == nil || opts.Kinds[kind]
+}
+
+// A fileTags is the state of one call of FileTags or DeclTags: the tags computed so far, and the
+// options and FileSet they are computed with.
+type fileTags struct {
+	File
+	opts *Options
+	fset *token.FileSet
+}
+
+func (ft *fileTags) declTags(inputFn, inputText string, decls []ast.Decl) {
+	opts := ft.opts
+	for _, d := range decls {
+		if fd, ok := d.(*ast.FuncDecl); ok {
+			var recvName string
+			if fd.Recv != nil && len(fd.Recv.List) > 0 {
+				if name := namedType(fd.Recv.List[0].Type); name != nil {
+					recvName = name.Name
+				}
+			}
+			if !opts.ExportedOnly || recvName == "" || token.IsExported(recvName) {
+				ft.addTag(inputText, recvName, fd.Name, KindFunc)
+			}
+			if opts.SignatureRefs {
+				ft.funcSignatureRefs(inputText, fd.Type)
+			}
+			if opts.ReceiverRefs && fd.Recv != nil && len(fd.Recv.List) > 0 {
+				ft.addRef(inputText, namedType(fd.Recv.List[0].Type))
+			}
+			continue
+		}
+		if item, ok := d.(*ast.GenDecl); ok {
+			switch item.Tok {
+			case token.IMPORT:
+				for _, spec := range item.Specs {
+					is := spec.(*ast.ImportSpec)
+					if opts.Imports && is.Name != nil && is.Name.Name != "_" && is.Name.Name != "." {
+						ft.addTag(inputText, "", is.Name, KindImport)
+					}
+				}
+			case token.TYPE:
+				for _, spec := range item.Specs {
+					ts := spec.(*ast.TypeSpec)
+					if ts.Name == nil {
+						continue
+					}
+					ft.addTag(inputText, "", ts.Name, KindType)
+					public := !opts.ExportedOnly || ts.Name.IsExported()
+					if opts.AliasTargets && ts.Assign.IsValid() && public {
+						ft.aliasTargetTag(inputText, ts.Type)
+					}
+					if it, ok := ts.Type.(*ast.InterfaceType); ok && public {
+						ft.interfaceTypeTags(inputText, ts.Name.Name, it, true)
+					} else if it := elementStructType(ts.Type); it != nil && public {
+						ft.structTypeTags(inputText, ts.Name.Name, it)
+					}
+					if it, ok := ts.Type.(*ast.StructType); ok {
+						ft.Structs = append(ft.Structs, Struct{ts.Name.Name, it})
+					}
+				}
+			case token.VAR, token.CONST:
+				// A constant without type or value repeats those of the previous one in the group.
+				var constType string
+				for _, spec := range item.Specs {
+					vs := spec.(*ast.ValueSpec)
+					if vs.Type != nil || len(vs.Values) > 0 {
+						constType = enumTypeName(vs.Type)
+					}
+					n := len(ft.Tags)
+					for _, name := range vs.Names {
+						ft.addTag(inputText, "", name, item.Tok.String())
+					}
+					if item.Tok == token.CONST && opts.EnumScope {
+						for i := n; i < len(ft.Tags); i++ {
+							ft.Tags[i].Scope = constType
+						}
+					}
+					if item.Tok == token.VAR {
+						public := !opts.ExportedOnly || slices.ContainsFunc(vs.Names, (*ast.Ident).IsExported)
+						if it, ok := vs.Type.(*ast.StructType); ok && public {
+							ft.structTypeTags(inputText, "", it)
+						}
+						// The struct type may instead be that of the value, as in
+						// var Config = struct{ ... }{ ... }.
+						for _, value := range vs.Values {
+							if vs.Type != nil || !public {
+								break
+							}
+							if it := literalStructType(value); it != nil {
+								ft.structTypeTags(inputText, "", it)
+							}
+						}
+						if opts.AnonFuncs {
+							ft.anonFuncTags(inputFn, inputText, vs)
+						}
+					}
+				}
+			}
+		}
+	}
+	ft.Tags = opts.Filter(ft.Tags)
+}
+
+// literalStructType returns the anonymous struct type of a composite literal or its address, or nil
+// if there is none.
+func literalStructType(e ast.Expr) *ast.StructType {
+	if ue, ok := e.(*ast.UnaryExpr); ok && ue.Op == token.AND {
+		e = ue.X
+	}
+	if cl, ok := e.(*ast.CompositeLit); ok {
+		if it, ok := cl.Type.(*ast.StructType); ok {
+			return it
+		}
+	}
+	return nil
+}
+
+// elementStructType returns the anonymous struct type reached by unwrapping slice and array element
+// types, map value types and pointer targets, or nil if there is none.
+func elementStructType(e ast.Expr) *ast.StructType {
+	for {
+		switch t := e.(type) {
+		case *ast.StructType:
+			return t
+		case *ast.ArrayType:
+			e = t.Elt
+		case *ast.MapType:
+			e = t.Value
+		case *ast.StarExpr:
+			e = t.X
+		default:
+			return nil
+		}
+	}
+}
+
+// The members of a nested struct or interface are qualified by the outer type name and the field
+// name, if the field has a single name.  Structs nested in slice, array, map and pointer types are
+// descended into as well.
+func (ft *fileTags) structTypeTags(inputText, typeName string, it *ast.StructType) {
+	if !ft.opts.kind(KindMember) || ft.opts.NoStructMembers {
+		return
+	}
+	ft.nestedStructTags(inputText, typeName, it, make(map[*ast.StructType]bool))
+}
+
+// Seen guards against revisiting a struct type; the AST of a type literal is a tree, but a cycle
+// would otherwise recurse forever.
+func (ft *fileTags) nestedStructTags(
+	inputText, typeName string,
+	it *ast.StructType,
+	seen map[*ast.StructType]bool,
+) {
+	if seen[it] {
+		return
+	}
+	seen[it] = true
+	for _, field := range it.Fields.List {
+		kind := KindMember
+		if _, ok := field.Type.(*ast.FuncType); ok {
+			kind = KindMethodField
+		}
+		for _, name := range field.Names {
+			ft.addTag(inputText, typeName, name, kind)
+		}
+		if len(field.Names) == 0 {
+			if name := embeddedName(field.Type); name != nil {
+				ft.addTag(inputText, typeName, name, KindMember)
+			}
+		}
+		innerName := ""
+		if typeName != "" && len(field.Names) == 1 {
+			innerName = typeName + "." + field.Names[0].Name
+		}
+		if it := elementStructType(field.Type); it != nil {
+			ft.nestedStructTags(inputText, innerName, it, seen)
+		} else if it, ok := field.Type.(*ast.InterfaceType); ok && ft.opts.InlineMethods {
+			ft.interfaceTypeTags(inputText, innerName, it, false)
+		}
+	}
+}
+
+// An embedded field, or an interface embedded in an interface, is named by its type name, without
+// package qualifier, pointer or type arguments.
+func embeddedName(e ast.Expr) *ast.Ident {
+	if se, ok := e.(*ast.StarExpr); ok {
+		e = se.X
+	}
+	switch t := e.(type) {
+	case *ast.IndexExpr:
+		e = t.X
+	case *ast.IndexListExpr:
+		e = t.X
+	}
+	switch t := e.(type) {
+	case *ast.Ident:
+		return t
+	case *ast.SelectorExpr:
+		return t.Sel
+	}
+	return nil
+}
+
+// The target of an alias is tagged only if it is a name and not a predeclared one, as composite and
+// predeclared types have no declaration to go to.
+func (ft *fileTags) aliasTargetTag(inputText string, e ast.Expr) {
+	switch t := e.(type) {
+	case *ast.Ident:
+		if types.Universe.Lookup(t.Name) == nil {
+			ft.addTag(inputText, "", t, KindType)
+		}
+	case *ast.SelectorExpr:
+		ft.addTag(inputText, "", t.Sel, KindType)
+	}
+}
+
+// enumTypeName returns the name of the declared type of a constant, or "" if it has none or it is a
+// predeclared type.
+func enumTypeName(e ast.Expr) string {
+	switch t := e.(type) {
+	case *ast.Ident:
+		if types.Universe.Lookup(t.Name) == nil {
+			return t.Name
+		}
+	case *ast.SelectorExpr:
+		return t.Sel.Name
+	}
+	return ""
+}
+
+// Embedded interfaces are tagged if embeds is set.
+func (ft *fileTags) interfaceTypeTags(
+	inputText, typeName string,
+	it *ast.InterfaceType,
+	embeds bool,
+) {
+	if ft.opts.NoInterfaceMembers {
+		return
+	}
+	for _, field := range it.Methods.List {
+		if _, ok := field.Type.(*ast.FuncType); ok && len(field.Names) > 0 {
+			ft.addTag(inputText, typeName, field.Names[0], KindMember)
+		} else if len(field.Names) == 0 && embeds {
+			if name := embeddedName(field.Type); name != nil {
+				ft.addTag(inputText, typeName, name, KindMember)
+			}
+		}
+	}
+}
+
+// addTag tags a name, and with QualifiedMembers also tags it as typeName.name with the same pattern
+// if typeName is not "".  The typeName of a method is its receiver type.  The AST of a file with
+// syntax errors can lack names, or have names without positions, and those are not tagged.
+func (ft *fileTags) addTag(inputText, typeName string, name *ast.Ident, kind string) {
+	if !ft.inText(inputText, name) {
+		return
+	}
+	t := makeTag(ft.fset, inputText, name, kind)
+	if kind == KindFunc {
+		t.Receiver = typeName
+	}
+	ft.Tags = append(ft.Tags, t)
+	if ft.opts.QualifiedMembers && typeName != "" {
+		t.Name = typeName + "." + t.Name
+		ft.Tags = append(ft.Tags, t)
+	}
+}
+
+// addRef records a reference to a type name, if there is one.
+func (ft *fileTags) addRef(inputText string, name *ast.Ident) {
+	if ft.inText(inputText, name) {
+		ft.Refs = append(ft.Refs, makeTag(ft.fset, inputText, name, KindType))
+	}
+}
+
+// inText is true if name is present in the text.  For a declaration that is cut off at the end of
+// the text the parser makes up a name "_" positioned at the end, which is not.
+func (ft *fileTags) inText(inputText string, name *ast.Ident) bool {
+	return name != nil && name.NamePos.IsValid() &&
+		ft.fset.File(name.NamePos).Offset(name.NamePos)+len(name.Name) <= len(inputText)
+}
+
+// Record references to the named types in the parameters and results of a function signature,
+// except predeclared types and the function's own type parameters.
+func (ft *fileTags) funcSignatureRefs(inputText string, fnType *ast.FuncType) {
+	typeParams := make(map[string]bool)
+	if fnType.TypeParams != nil {
+		for _, field := range fnType.TypeParams.List {
+			for _, name := range field.Names {
+				typeParams[name.Name] = true
+			}
+		}
+	}
+	for _, fields := range []*ast.FieldList{fnType.Params, fnType.Results} {
+		if fields == nil {
+			continue
+		}
+		for _, field := range fields.List {
+			if name := namedType(field.Type); name != nil &&
+				!typeParams[name.Name] && types.Universe.Lookup(name.Name) == nil {
+				ft.addRef(inputText, name)
+			}
+		}
+	}
+}
+
+// namedType returns the identifier naming the type reached by unwrapping pointer, slice, array,
+// variadic, channel and generic instantiation types, the selector for qualified names, or nil if
+// that type is not named.
+func namedType(e ast.Expr) *ast.Ident {
+	for {
+		switch t := e.(type) {
+		case *ast.Ident:
+			return t
+		case *ast.SelectorExpr:
+			return t.Sel
+		case *ast.StarExpr:
+			e = t.X
+		case *ast.ArrayType:
+			e = t.Elt
+		case *ast.Ellipsis:
+			e = t.Elt
+		case *ast.ChanType:
+			e = t.Value
+		case *ast.IndexExpr:
+			e = t.X
+		case *ast.IndexListExpr:
+			e = t.X
+		case *ast.ParenExpr:
+			e = t.X
+		default:
+			return nil
+		}
+	}
+}
+
+// A directive is "//go:linkname local remote", or "//go:linkname local" to export local for use by
+// another package.  The pattern ends with the local name.
+func (ft *fileTags) linknameTags(inputText string, comments []*ast.CommentGroup) {
+	const directive = "//go:linkname "
+	for _, cg := range comments {
+		for _, c := range cg.List {
+			args, found := strings.CutPrefix(c.Text, directive)
+			fields := strings.Fields(args)
+			if !found || len(fields) == 0 || len(fields) > 2 {
+				continue
+			}
+			local := fields[0]
+			pos := c.Slash + token.Pos(len(directive)+strings.Index(args, local))
+			ft.Tags = append(ft.Tags, makeTagAt(ft.fset, inputText, pos, len(local), local, KindLinkname))
+		}
+	}
+}
+
+// Function literals have no names, so that those that are notable - assigned to exported variables,
+// or to exported fields in composite literals - can be found they are given synthetic names from
+// their positions, "func@file:line".  The pattern ends with the "func" keyword.
+func (ft *fileTags) anonFuncTags(inputFn, inputText string, vs *ast.ValueSpec) {
+	anonTag := func(fl *ast.FuncLit) {
+		line := ft.fset.File(fl.Pos()).Line(fl.Pos())
+		name := fmt.Sprintf("func@%s:%d", inputFn, line)
+		ft.Tags = append(ft.Tags, makeTagAt(ft.fset, inputText, fl.Pos(), len("func"), name, KindFunc))
+	}
+	for i, value := range vs.Values {
+		if fl, ok := value.(*ast.FuncLit); ok && i < len(vs.Names) && vs.Names[i].IsExported() {
+			anonTag(fl)
+			continue
+		}
+		ast.Inspect(value, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.KeyValueExpr:
+				key, isIdent := n.Key.(*ast.Ident)
+				if fl, ok := n.Value.(*ast.FuncLit); ok && isIdent && key.IsExported() {
+					anonTag(fl)
+					return false
+				}
+			}
+			return true
+		})
+	}
+}
+
+func makeTag(fset *token.FileSet, inputText string, name *ast.Ident, kind string) Tag {
+	return makeTagAt(fset, inputText, name.NamePos, len(name.Name), name.Name, kind)
+}
+
+// makeTagAt makes a tag whose pattern runs from the start of the line through the length bytes at
+// pos.  A byte order mark at the start of the file is not part of the first line, as editors do not
+// show it, so the first line starts after it.
+func makeTagAt(
+	fset *token.FileSet,
+	inputText string,
+	pos token.Pos,
+	length int,
+	name, kind string,
+) Tag {
+	tf := fset.File(pos)
+	offs := tf.Offset(pos)
+	line := tf.Line(pos)
+	end := offs + length
+	for offs > 0 && inputText[offs-1] != '\n' {
+		offs--
+	}
+	if offs == 0 && strings.HasPrefix(inputText, ByteOrderMark) {
+		offs = len(ByteOrderMark)
+	}
+	return Tag{
+		Name:      name,
+		Kind:      kind,
+		Line:      line,
+		Offset:    offs,
+		EndOffset: end,
+		Pattern:   inputText[offs:end],
+	}
+}
+
+// ByteOrderMark is the UTF-8 encoding of the byte order mark, which some editors put at the start
+// of a file.
+const ByteOrderMark = "\uFEFF"
@@ -0,0 +1,163 @@
+// SPDX-License-Identifier: MIT
+
+package tags
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+const src = `package p
+
+type T struct {
+	F int
+	g string
+}
+
+func (t *T) M() {}
+
+var V, w = 1, 2
+`
+
+func TestTagsForFile(t *testing.T) {
+	got, err := TagsForFile("p.go", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Tag{
+		{Name: "p", Kind: KindPackage, Line: 1, Offset: 0, EndOffset: 9, Pattern: "package p"},
+		{Name: "T", Kind: KindType, Line: 3, Offset: 11, EndOffset: 17, Pattern: "type T"},
+		{Name: "F", Kind: KindMember, Line: 4, Offset: 27, EndOffset: 29, Pattern: "\tF"},
+		{Name: "g", Kind: KindMember, Line: 5, Offset: 34, EndOffset: 36, Pattern: "\tg"},
+		{Name: "M", Kind: KindFunc, Line: 8, Offset: 47, EndOffset: 60, Pattern: "func (t *T) M", Receiver: "T"},
+		{Name: "V", Kind: KindVar, Line: 10, Offset: 67, EndOffset: 72, Pattern: "var V"},
+		{Name: "w", Kind: KindVar, Line: 10, Offset: 67, EndOffset: 75, Pattern: "var V, w"},
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("Got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestTagsForFileError(t *testing.T) {
+	if _, err := TagsForFile("bad.go", []byte("package p\nfunc {")); err == nil {
+		t.Fatal("No error for bad source")
+	}
+}
+
+func TestOptions(t *testing.T) {
+	tags, err := TagsForFile("p.go", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Kinds: map[string]bool{KindType: true, KindVar: true}, ExportedOnly: true}
+	var names []string
+	for _, tag := range opts.Filter(tags) {
+		names = append(names, tag.Name)
+	}
+	if want := []string{"T", "V"}; !slices.Equal(names, want) {
+		t.Fatalf("Got %q want %q", names, want)
+	}
+}
+
+func TestBlankIdentifier(t *testing.T) {
+	got, err := TagsForFile("b.go", []byte("package b\nvar _ = 1\nfunc _() {}\ntype T struct{ _ int }\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range got {
+		if tag.Name == "_" {
+			t.Fatalf("Blank identifier tagged: %+v", got)
+		}
+	}
+}
+
+func TestReceiver(t *testing.T) {
+	src := `package r
+
+type V int
+type G[K comparable, E any] struct{}
+
+func (v V) Value()          {}
+func (v *V) Pointer()       {}
+func (g *G[K, E]) Generic() {}
+func (G[K, E]) Unnamed()    {}
+func Plain()                {}
+`
+	got, err := TagsForFile("r.go", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receivers := make(map[string]string)
+	for _, tag := range got {
+		receivers[tag.Name] = tag.Receiver
+	}
+	want := map[string]string{
+		"r": "", "V": "", "G": "", "Value": "V", "Pointer": "V", "Generic": "G", "Unnamed": "G", "Plain": "",
+	}
+	if !maps.Equal(receivers, want) {
+		t.Fatalf("Got %q want %q", receivers, want)
+	}
+}
+
+// The fields of a named struct type are tagged at the type declaration only, not again at the
+// variables of the type.
+func TestNamedStructVars(t *testing.T) {
+	src := `package p
+
+type Config struct {
+	Name string
+	Port int
+}
+
+var Default Config
+var A, B Config
+var (
+	P = Config{Name: "p"}
+	Q *Config
+	R []Config
+)
+`
+	tags, err := TagsForFile("p.go", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var members []Tag
+	for _, tag := range tags {
+		if tag.Kind == KindMember {
+			members = append(members, tag)
+		}
+	}
+	want := []Tag{
+		{Name: "Name", Kind: KindMember, Line: 4, Offset: 32, EndOffset: 37, Pattern: "\tName"},
+		{Name: "Port", Kind: KindMember, Line: 5, Offset: 45, EndOffset: 50, Pattern: "\tPort"},
+	}
+	if !slices.Equal(members, want) {
+		t.Fatalf("Got %+v\nwant %+v", members, want)
+	}
+}
+
+// Constants whose values are implicitly repeated have no Values but are tagged all the same.
+func TestImplicitConstValues(t *testing.T) {
+	src := `package p
+
+const (
+	A = iota
+	B
+	C
+)
+`
+	tags, err := TagsForFile("p.go", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Tag{
+		{Name: "p", Kind: KindPackage, Line: 1, Offset: 0, EndOffset: 9, Pattern: "package p"},
+		{Name: "A", Kind: KindConst, Line: 4, Offset: 19, EndOffset: 21, Pattern: "\tA"},
+		{Name: "B", Kind: KindConst, Line: 5, Offset: 29, EndOffset: 31, Pattern: "\tB"},
+		{Name: "C", Kind: KindConst, Line: 6, Offset: 32, EndOffset: 34, Pattern: "\tC"},
+	}
+	if !slices.Equal(tags, want) {
+		t.Fatalf("Got %+v\nwant %+v", tags, want)
+	}
+}
@@ -0,0 +1,13 @@
+package aliases
+
+import "io/fs"
+
+type Bytes = []byte
+type MyError = fs.PathError
+type Name = string
+type (
+	Ptr   = *Name
+	Local = Name
+)
+type Distinct Name
+type Generic = List[int]
@@ -0,0 +1,12 @@
+package anon
+
+var OnStart = func() {}
+
+var onStop = func() {}
+
+var Handlers = struct{ OnClick, onHover func() }{
+	OnClick: func() {},
+	onHover: func() {},
+}
+
+var Table = map[string]func(){"a": func() {}}
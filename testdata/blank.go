@@ -0,0 +1,20 @@
+package blank
+
+import "fmt"
+
+var _ = fmt.Sprint()
+
+var _, Kept = 1, 2
+
+const _ = iota
+
+func _() {}
+
+type Padded struct {
+	_    [4]byte
+	Word uint32
+}
+
+var _ fmt.Stringer = (*Padded)(nil)
+
+func (*Padded) String() string { return "" }
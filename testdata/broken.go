@@ -0,0 +1 @@
+nonexistent.go
\ No newline at end of file
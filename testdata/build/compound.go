@@ -0,0 +1,7 @@
+// Only on 64-bit Intel Linux or on macOS.
+
+//go:build (linux && amd64) || darwin
+
+package build
+
+func Compound() {}
@@ -0,0 +1,7 @@
+// Only with the feature.
+
+//go:build feature && !nofeature
+
+package build
+
+func Feature() {}
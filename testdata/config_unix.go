@@ -0,0 +1,9 @@
+//go:build unix
+
+package config
+
+type Config struct {
+	Path      string
+	Mode, Uid int
+	Socket    string
+}
@@ -0,0 +1,8 @@
+//go:build windows
+
+package config
+
+type Config struct {
+	Path, Mode string
+	Pipe       string
+}
@@ -0,0 +1,4 @@
+package constraint
+
+// The constraint of T is an inline interface, which has a method but no fields.
+func F[T interface{ M() }]() {}
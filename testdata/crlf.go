@@ -0,0 +1,10 @@
+// This file has CRLF line endings, do not convert it.  See gotags_test.go for instructions.
+package crlf //D |package crlf|
+
+type T struct { //D |type T|
+	F int //D |	F|
+}
+
+func (t T) M() {} //D |func (t T) M|
+
+var V, W = 1, 2 //D |var V|var V, W|
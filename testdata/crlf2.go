@@ -0,0 +1,9 @@
+// This file has CRLF line endings and a syntax error, do not convert it.
+
+//builtin-etags
+
+package crlf2 //D |package crlf2|
+
+type T int; type U int //D |type T|type T int; type U|
+
+func F() { ++x } //D |func F|
@@ -0,0 +1,41 @@
+package exported
+
+type Public struct {
+	Name  string
+	count int
+}
+
+type private struct {
+	Field int
+}
+
+func Exported() {}
+
+func unexported() {}
+
+func (p *Public) Method() {}
+
+func (p *Public) method() {}
+
+var V, v = 1, 2
+
+const (
+	C = iota
+	c
+)
+
+type Iface interface {
+	Do()
+	undo()
+}
+
+func (p private) Method() {}
+
+var S, s struct {
+	X int
+	y int
+}
+
+var t struct {
+	Z int
+}
@@ -0,0 +1,3 @@
+package ff
+
+var A, /**/ B int
@@ -0,0 +1,16 @@
+// Generic receivers under etags-style parsing.  This is not well-formed Go (there's a syntax error
+// at the end), do not reformat it.
+
+//builtin-etags
+
+package generics //D |package generics|
+
+func (t Tree[T]) Insert(v T) { } //D |func (t Tree[T]) Insert|
+func (t *Tree[T]) Delete(v T) { } //D |func (t *Tree[T]) Delete|
+func (m Map[K, V]) Get(k K) (V, bool) { } //D |func (m Map[K, V]) Get|
+func (m *Map[K, V]) Put(k K, v V) { } //D |func (m *Map[K, V]) Put|
+func (Map[K, V]) Len() int { return 0 } //D |func (Map[K, V]) Len|
+func (p (Pair[K, V])) First() K { } //D |func (p (Pair[K, V])) First|
+func (m Map[K, V]) Keys() []K { }; func (m Map[K, V]) Values() []V { } //D |func (m Map[K, V]) Keys|func (m Map[K, V]) Keys() []K { }; func (m Map[K, V]) Values|
+
+func broken( { } //D |func broken|
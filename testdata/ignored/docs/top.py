@@ -0,0 +1 @@
+def top(): pass
@@ -0,0 +1,12 @@
+package imports
+
+import (
+	"fmt"
+	str "strings"
+	_ "embed"
+	. "math"
+)
+
+import sc "strconv"
+
+var _ = fmt.Sprint(str.ToUpper(sc.Itoa(int(Pi))))
@@ -0,0 +1,9 @@
+package inline
+
+type Server struct {
+	Handler interface{ Serve() }
+	Logger  interface {
+		fmt.Stringer
+		Log(msg string)
+	}
+}
@@ -0,0 +1,14 @@
+package late
+
+const Limit = 10
+
+type Config struct {
+	Name  string
+	Level int
+}
+
+func (c *Config) Valid() bool { return c.Level < Limit }
+
+func broken() {
+	x := ++
+}
@@ -0,0 +1,13 @@
+package linkname
+
+import _ "unsafe"
+
+// nanotime is implemented by the runtime.
+//
+//go:linkname nanotime runtime.nanotime
+func nanotime() int64
+
+//go:linkname Exported
+func Exported() {}
+
+// Not a directive: go:linkname ignored runtime.ignored
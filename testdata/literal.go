@@ -0,0 +1,13 @@
+package literal
+
+var Config = struct {
+	Host string
+	Port int
+}{
+	Host: "localhost",
+	Port: 8080,
+}
+
+var Defaults = &struct{ Timeout int }{Timeout: 30}
+
+var Names = []string{"a"}
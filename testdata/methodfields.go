@@ -0,0 +1,10 @@
+package methodfields
+
+type Event struct{ Name string }
+
+type Button struct {
+	Label   string
+	OnClick func(Event)
+	Width   int
+	Filter  func(string) bool
+}
@@ -0,0 +1,11 @@
+package methods
+
+type T[E any] struct{}
+
+func (t T[E]) Get() E { var e E; return e }
+
+func (t *T[E]) Set(e E) {}
+
+func (*T[E]) Reset() {}
+
+func NotAMethod() {}
@@ -0,0 +1,9 @@
+// Größe und Maße: a comment with non-ASCII text before the package clause.
+package multibyte
+
+// Ärger is a type with a non-ASCII name.
+type Ärger int
+
+var Größe = "日本語"
+
+func Maß() {}
@@ -0,0 +1,6 @@
+// Code generated by hand, but you may EDIT this.
+
+package gen
+
+// Code generated by nothing. DO NOT EDIT.
+func NearMiss() {}
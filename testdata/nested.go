@@ -0,0 +1,9 @@
+package nested
+
+type Catalog struct {
+	Items  []struct{ ID int }
+	Fixed  [4]struct{ Slot int }
+	Lookup map[string]struct{ V int }
+	Ref    *struct{ Target string }
+	Deep   []map[string]*struct{ Leaf bool }
+}
@@ -0,0 +1,18 @@
+package qualified
+
+type t3 struct {
+	f1    int
+	inner struct {
+		f2 int
+	}
+}
+
+type I interface {
+	m1()
+}
+
+func (p *t3) m1() {}
+
+func (l List[T]) Len() int { return 0 }
+
+func F() {}
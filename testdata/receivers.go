@@ -0,0 +1,13 @@
+package receivers
+
+type V int
+
+func (v V) Value() {}
+
+func (v *V) Pointer() {}
+
+type G[K comparable, E any] struct{}
+
+func (g *G[K, E]) Generic() {}
+
+func Plain() {}
@@ -0,0 +1,9 @@
+package refs
+
+type Server struct{}
+
+type Options struct{}
+
+func New(opts *Options) (*Server, error) { return nil, nil }
+
+func Serve[T any](s []Server, xs ...T) chan<- io.Reader { return nil }
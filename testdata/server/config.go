@@ -0,0 +1,6 @@
+package server
+
+// Config of another package, unrelated to config.Config.
+type Config struct {
+	Addr string
+}
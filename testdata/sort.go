@@ -0,0 +1,14 @@
+package sort
+
+var zeta int
+
+type Beta struct {
+	alpha int
+}
+
+func Alpha() {}
+
+var (
+	Älg   = 1
+	delta = 2
+)
@@ -0,0 +1,20 @@
+package stringer
+
+type Pill int
+
+const (
+	Placebo Pill = iota
+	Aspirin
+	Ibuprofen
+)
+
+func (p Pill) String() string {
+	return [...]string{"Placebo", "Aspirin", "Ibuprofen"}[p]
+}
+
+const Untyped = 1
+
+const (
+	Limit  int = 10
+	Repeat
+)
@@ -0,0 +1 @@
+mod/a.go
\ No newline at end of file
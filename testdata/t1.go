@@ -48,3 +48,66 @@ type i1 interface {				//D |type i1|
 	if1(x int) int 				//D |	if1|
 	if2(y int) int				//D |	if2|
 }
+
+type Rows []struct { //D |type Rows|
+	ID int //D |	ID|
+	Name string //D |	Name|
+}
+type RowMap map[string]*struct { //D |type RowMap|
+	Key int //D |	Key|
+}
+
+type A1 int; type B1 int //D |type A1|type A1 int; type B1|
+
+const (
+	E1 = iota //D |	E1|
+	E2 //D |	E2|
+	E3 = 10 //D |	E3|
+	E4 //D |	E4|
+)
+
+type (
+	S1 struct{ X1 int } //D |	S1|	S1 struct{ X1|
+	I1 interface{ M1() } //D |	I1|	I1 interface{ M1|
+	S2 struct { //D |	S2|
+		X2, Y2 int //D |		X2|		X2, Y2|
+	}
+)
+
+type Embeds struct { //D |type Embeds|
+	io.Reader //D |	io.Reader|
+	*Mutex //D |	*Mutex|
+	Plain //D |	Plain|
+	*sync.WaitGroup //D |	*sync.WaitGroup|
+	named int //D |	named|
+}
+
+type ReadWriter interface { //D |type ReadWriter|
+	Reader //D |	Reader|
+	io.Writer //D |	io.Writer|
+	constraints.Ordered //D |	constraints.Ordered|
+	Close() error //D |	Close|
+	~int | ~string
+}
+
+type Signed interface{ ~int | ~int64 } //D |type Signed|
+type Number interface{ Signed; Abs() Number } //D |type Number|type Number interface{ Signed|type Number interface{ Signed; Abs|
+type Number2 interface { //D |type Number2|
+	Signed //D |	Signed|
+	~float32 | ~float64
+	Abs() Number2 //D |	Abs|
+}
+
+// Constants with implicitly repeated values.
+const (
+	K1 = iota //D |	K1|
+	K2 //D |	K2|
+	K3 //D |	K3|
+)
+const ( L1 = iota; L2; L3 ) //D |const ( L1|const ( L1 = iota; L2|const ( L1 = iota; L2; L3|
+
+type Cache struct { //D |type Cache|
+	Store[string] //D |	Store|
+	*Pair[int, string] //D |	*Pair|
+	pkg.List[T] //D |	pkg.List|
+}
@@ -30,4 +30,12 @@ func F2[T any](x int) { //D |func F2|
 	type lt1 = int
 }
 
+type PA int; type PB int //D |type PA|type PA int; type PB|
+var PV int; const PC = 1 //D |var PV|var PV int; const PC|
+
+func Do_Thing2() { } //D |func Do_Thing2|
+var _under9 int //D |var _under9|
+type T3_x4 int; func F_5() { } //D |type T3_x4|type T3_x4 int; func F_5|
+var 9bad int // Not tagged, not an identifier
+
 func bad() { ++x } //D |func bad|
@@ -0,0 +1,7 @@
+package truncated
+
+func Complete() {}
+
+var V = 1
+
+type
\ No newline at end of file
@@ -0,0 +1,5 @@
+//go:build linux
+
+package version
+
+const Version = "1.0-linux"
@@ -0,0 +1,5 @@
+//go:build !linux
+
+package version
+
+var Version = "1.0"
@@ -5,17 +5,49 @@ package utils
 
 import (
 	"bufio"
+	"bytes"
 	"io"
 	"iter"
 )
 
-func GenerateLinesFromReader(input io.Reader) iter.Seq[string] {
-	return func(yield func(string) bool) {
+// MaxLineLength is the length of the longest line GenerateLinesFromReader can yield.
+const MaxLineLength = 16 * 1024 * 1024
+
+// GenerateLinesFromReader yields the lines of input without their line endings, paired with a nil
+// error.  If reading fails, or a line is longer than MaxLineLength, the last pair yielded has the
+// error.
+func GenerateLinesFromReader(input io.Reader) iter.Seq2[string, error] {
+	return generateTokens(input, bufio.ScanLines)
+}
+
+// GenerateNulSeparatedFromReader is like GenerateLinesFromReader but yields the NUL-terminated
+// strings of input, as written by find -print0.  The last string need not be terminated.
+func GenerateNulSeparatedFromReader(input io.Reader) iter.Seq2[string, error] {
+	return generateTokens(input, scanNulTerminated)
+}
+
+func generateTokens(input io.Reader, split bufio.SplitFunc) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
 		scanner := bufio.NewScanner(input)
+		scanner.Buffer(make([]byte, 0, 64*1024), MaxLineLength)
+		scanner.Split(split)
 		for scanner.Scan() {
-			if !yield(scanner.Text()) {
-				break
+			if !yield(scanner.Text(), nil) {
+				return
 			}
 		}
+		if err := scanner.Err(); err != nil {
+			yield("", err)
+		}
+	}
+}
+
+func scanNulTerminated(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
 	}
+	return 0, nil, nil
 }
@@ -0,0 +1,53 @@
+// SPDX-License-Identifier: MIT
+
+package utils
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestLongLines(t *testing.T) {
+	long := strings.Repeat("x", 200*1024)
+	var lines []string
+	for l, err := range GenerateLinesFromReader(strings.NewReader("a\n" + long + "\nb\n")) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, l)
+	}
+	if len(lines) != 3 || lines[0] != "a" || lines[1] != long || lines[2] != "b" {
+		t.Fatalf("Lines not yielded intact")
+	}
+}
+
+func TestTooLongLine(t *testing.T) {
+	tooLong := strings.Repeat("x", MaxLineLength+1)
+	var lines []string
+	var lastErr error
+	for l, err := range GenerateLinesFromReader(strings.NewReader("a\n" + tooLong + "\n")) {
+		if err != nil {
+			lastErr = err
+			break
+		}
+		lines = append(lines, l)
+	}
+	if len(lines) != 1 || lastErr != bufio.ErrTooLong {
+		t.Fatalf("Expected one line and ErrTooLong, got %d lines and %v", len(lines), lastErr)
+	}
+}
+
+func TestNulSeparated(t *testing.T) {
+	var got []string
+	for s, err := range GenerateNulSeparatedFromReader(strings.NewReader("a b\x00c\nd\x00\x00e")) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, s)
+	}
+	want := []string{"a b", "c\nd", "", "e"}
+	if strings.Join(got, "|") != strings.Join(want, "|") || len(got) != len(want) {
+		t.Fatalf("Got %q want %q", got, want)
+	}
+}
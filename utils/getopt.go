@@ -53,6 +53,7 @@ package utils
 import (
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
 )
 
@@ -275,6 +276,19 @@ func SetFlag(flagp *bool) func(string) error {
 	}
 }
 
+// A simple handler that will set an int to a given value, and fail if the value is not a decimal
+// integer
+func SetInt(intp *int) func(string) error {
+	return func(s string) error {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("Not an integer: \"%s\"", s)
+		}
+		*intp = n
+		return nil
+	}
+}
+
 // A simple handler that will set a string to a given value and always succeed
 func SetString(stringp *string) func(string) error {
 	return func(s string) error {
@@ -0,0 +1,111 @@
+// SPDX-License-Identifier: MIT
+
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLongValue(t *testing.T) {
+	for _, args := range [][]string{{"--etags=x"}, {"--etags", "x"}} {
+		var etags string
+		var quiet bool
+		opts := []Option{
+			{Long: "etags", Value: true, Handler: SetString(&etags)},
+			{Long: "quiet", Handler: SetFlag(&quiet)},
+		}
+		rest, err := GetOpts(opts, args)
+		if err != nil {
+			t.Fatalf("%q: %v", args, err)
+		}
+		if etags != "x" || quiet || len(rest) != 0 {
+			t.Fatalf("%q: Got etags %q quiet %v rest %q", args, etags, quiet, rest)
+		}
+	}
+}
+
+func TestLongValueEmpty(t *testing.T) {
+	etags := "default"
+	opts := []Option{{Long: "etags", Value: true, Handler: SetString(&etags)}}
+	if _, err := GetOpts(opts, []string{"--etags="}); err != nil || etags != "" {
+		t.Fatalf("Got etags %q err %v", etags, err)
+	}
+}
+
+func TestFlagWithValue(t *testing.T) {
+	var quiet bool
+	opts := []Option{{Long: "quiet", Handler: SetFlag(&quiet)}}
+	_, err := GetOpts(opts, []string{"--quiet=1"})
+	if err == nil || !strings.Contains(err.Error(), "does not take a value") {
+		t.Fatalf("Got err %v", err)
+	}
+	if quiet {
+		t.Fatalf("Handler called for rejected option")
+	}
+}
+
+func shortOptions(quiet, verbose *bool, output, etags *string) []Option {
+	return []Option{
+		{Short: 'q', Handler: SetFlag(quiet)},
+		{Short: 'v', Handler: SetFlag(verbose)},
+		{Short: 'o', Value: true, Handler: SetString(output)},
+		{Short: 'e', Value: true, Handler: SetString(etags)},
+	}
+}
+
+func TestCombinedShortFlags(t *testing.T) {
+	var quiet, verbose bool
+	var output, etags string
+	if _, err := GetOpts(shortOptions(&quiet, &verbose, &output, &etags), []string{"-qv"}); err != nil {
+		t.Fatal(err)
+	}
+	if !quiet || !verbose {
+		t.Fatalf("Got quiet %v verbose %v", quiet, verbose)
+	}
+}
+
+func TestShortValue(t *testing.T) {
+	for _, args := range [][]string{{"-ofile"}, {"-o", "file"}, {"-qofile"}, {"-qo", "file"}} {
+		var quiet, verbose bool
+		var output, etags string
+		if _, err := GetOpts(shortOptions(&quiet, &verbose, &output, &etags), args); err != nil {
+			t.Fatalf("%q: %v", args, err)
+		}
+		if output != "file" || verbose || quiet != (args[0][1] == 'q') {
+			t.Fatalf("%q: Got output %q quiet %v verbose %v", args, output, quiet, verbose)
+		}
+	}
+}
+
+func TestCompetingShortValues(t *testing.T) {
+	var quiet, verbose bool
+	var output, etags string
+	_, err := GetOpts(shortOptions(&quiet, &verbose, &output, &etags), []string{"-oe", "file"})
+	if err == nil || !strings.Contains(err.Error(), "compete for a value") {
+		t.Fatalf("Got err %v", err)
+	}
+}
+
+func TestSetInt(t *testing.T) {
+	for _, c := range []struct {
+		arg  string
+		want int
+	}{{"12", 12}, {"-3", -3}, {"0", 0}} {
+		n := 7
+		opts := []Option{{Long: "jobs", Value: true, Handler: SetInt(&n)}}
+		if _, err := GetOpts(opts, []string{"--jobs", c.arg}); err != nil || n != c.want {
+			t.Fatalf("%s: Got %d err %v", c.arg, n, err)
+		}
+	}
+	n := 7
+	opts := []Option{{Long: "jobs", Value: true, Handler: SetInt(&n)}}
+	_, err := GetOpts(opts, []string{"--jobs=many"})
+	if err == nil || !strings.Contains(err.Error(), `Not an integer: "many"`) ||
+		!strings.Contains(err.Error(), `"--jobs"`) {
+		t.Fatalf("Got err %v", err)
+	}
+	if n != 7 {
+		t.Fatalf("Value changed to %d by bad input", n)
+	}
+}